@@ -0,0 +1,252 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/derivita/bazelpackagesdriver/pkgconv"
+	"golang.org/x/tools/go/packages"
+)
+
+// aqueryID is an id from the aquery jsonproto output.
+// Older versions of bazel use strings, newer ones use integers.
+type aqueryID string
+
+func (id *aqueryID) UnmarshalJSON(data []byte) error {
+	*id = aqueryID(strings.Trim(string(data), `"`))
+	return nil
+}
+
+// actionGraph is the subset of `bazel aquery --output=jsonproto` used by the driver.
+type actionGraph struct {
+	Artifacts []struct {
+		ID             aqueryID `json:"id"`
+		ExecPath       string   `json:"execPath"`
+		PathFragmentID aqueryID `json:"pathFragmentId"`
+	} `json:"artifacts"`
+	Actions []struct {
+		TargetID       aqueryID   `json:"targetId"`
+		Mnemonic       string     `json:"mnemonic"`
+		InputDepSetIDs []aqueryID `json:"inputDepSetIds"`
+		OutputIDs      []aqueryID `json:"outputIds"`
+	} `json:"actions"`
+	DepSetOfFiles []struct {
+		ID                  aqueryID   `json:"id"`
+		DirectArtifactIDs   []aqueryID `json:"directArtifactIds"`
+		TransitiveDepSetIDs []aqueryID `json:"transitiveDepSetIds"`
+	} `json:"depSetOfFiles"`
+	Targets []struct {
+		ID    aqueryID `json:"id"`
+		Label string   `json:"label"`
+	} `json:"targets"`
+	PathFragments []struct {
+		ID       aqueryID `json:"id"`
+		Label    string   `json:"label"`
+		ParentID aqueryID `json:"parentId"`
+	} `json:"pathFragments"`
+}
+
+// generatedFiles asks bazel aquery which go files are written by the actions of labels.
+// The returned paths are absolute paths inside the execution root.
+func (d *bazelDriver) generatedFiles(labels []string) (pkgconv.GeneratedFiles, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	query := strings.Join(labels, " + ")
+	log.Printf("bazel aquery for %v targets", len(labels))
+	out, err := d.bazel.AQuery("--output=jsonproto", "--include_commandline=false", query)
+	if err != nil {
+		return nil, err
+	}
+	var graph actionGraph
+	if err := json.Unmarshal(out, &graph); err != nil {
+		return nil, err
+	}
+	return graph.goOutputs(d.execRoot), nil
+}
+
+// compileMnemonic is the mnemonic of the rules_go action that compiles a package.
+const compileMnemonic = "GoCompilePkg"
+
+// compiledFiles asks bazel aquery for the .go inputs of the actions that
+// compile labels. These are the files the compiler actually sees, including
+// the outputs of cgo and coverage instrumentation. A go_test has more than one
+// action, so each target has a list of files for each action.
+// The returned paths are execution root relative.
+func (d *bazelDriver) compiledFiles(labels []string) (map[string][][]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	query := fmt.Sprintf("mnemonic(%q, %v)", compileMnemonic, strings.Join(labels, " + "))
+	log.Printf("bazel aquery %v for %v targets", compileMnemonic, len(labels))
+	out, err := d.bazel.AQuery("--output=jsonproto", "--include_commandline=false", query)
+	if err != nil {
+		return nil, err
+	}
+	var graph actionGraph
+	if err := json.Unmarshal(out, &graph); err != nil {
+		return nil, err
+	}
+	return graph.compileInputs(), nil
+}
+
+// goOutputs returns the .go files written by each target's actions.
+func (g *actionGraph) goOutputs(execRoot string) pkgconv.GeneratedFiles {
+	labels, paths := g.labels(), g.paths()
+	result := make(pkgconv.GeneratedFiles)
+	for _, a := range g.Actions {
+		label := labels[a.TargetID]
+		for _, id := range a.OutputIDs {
+			if p := paths[id]; filepath.Ext(p) == ".go" {
+				result[label] = append(result[label], filepath.Join(execRoot, p))
+			}
+		}
+	}
+	return result
+}
+
+// compileInputs returns the .go inputs of the compile actions of each target.
+func (g *actionGraph) compileInputs() map[string][][]string {
+	labels, paths := g.labels(), g.paths()
+	depSets := make(map[aqueryID]int, len(g.DepSetOfFiles))
+	for i, d := range g.DepSetOfFiles {
+		depSets[d.ID] = i
+	}
+	result := make(map[string][][]string)
+	for _, a := range g.Actions {
+		if a.Mnemonic != compileMnemonic {
+			continue
+		}
+		var files []string
+		seen := make(map[aqueryID]bool)
+		var walk func(ids []aqueryID)
+		walk = func(ids []aqueryID) {
+			for _, id := range ids {
+				i, ok := depSets[id]
+				if !ok || seen[id] {
+					continue
+				}
+				seen[id] = true
+				for _, artifact := range g.DepSetOfFiles[i].DirectArtifactIDs {
+					if p := paths[artifact]; filepath.Ext(p) == ".go" {
+						files = append(files, p)
+					}
+				}
+				walk(g.DepSetOfFiles[i].TransitiveDepSetIDs)
+			}
+		}
+		walk(a.InputDepSetIDs)
+		label := labels[a.TargetID]
+		result[label] = append(result[label], files)
+	}
+	return result
+}
+
+// labels returns the label of each target.
+func (g *actionGraph) labels() map[aqueryID]string {
+	labels := make(map[aqueryID]string, len(g.Targets))
+	for _, t := range g.Targets {
+		labels[t.ID] = normalizeLabel(t.Label)
+	}
+	return labels
+}
+
+// paths returns the execution root relative path of each artifact.
+func (g *actionGraph) paths() map[aqueryID]string {
+	fragments := make(map[aqueryID]int, len(g.PathFragments))
+	for i, f := range g.PathFragments {
+		fragments[f.ID] = i
+	}
+	fragmentPath := func(id aqueryID) string {
+		var parts []string
+		for i, ok := fragments[id]; ok; i, ok = fragments[g.PathFragments[i].ParentID] {
+			parts = append([]string{g.PathFragments[i].Label}, parts...)
+		}
+		return filepath.Join(parts...)
+	}
+	paths := make(map[aqueryID]string, len(g.Artifacts))
+	for _, a := range g.Artifacts {
+		if a.ExecPath != "" {
+			paths[a.ID] = a.ExecPath
+		} else {
+			paths[a.ID] = fragmentPath(a.PathFragmentID)
+		}
+	}
+	return paths
+}
+
+// setCompiledGoFiles sets the CompiledGoFiles of pkgs to the .go inputs of the
+// actions that compile them, from compiledFiles. The packages for a go_test
+// are compiled by separate actions, so each package uses the action whose
+// inputs have the most file names in common with its GoFiles.
+// Inputs from the go sdk are left out. The inputs only replace CompiledGoFiles
+// if they include files generated by cgo; newer versions of rules_go run cgo
+// in the compile action, and then the files from Load are kept.
+func (d *bazelDriver) setCompiledGoFiles(pkgs []*packages.Package, compiled map[string][][]string) {
+	for _, pkg := range pkgs {
+		actions := compiled[targetLabel(pkg.ID)]
+		if len(actions) == 0 {
+			continue
+		}
+		stems := make(map[string]bool, len(pkg.GoFiles))
+		for _, f := range pkg.GoFiles {
+			stems[fileStem(f)] = true
+		}
+		best, bestCount := -1, 0
+		for i, inputs := range actions {
+			count := 0
+			for _, f := range inputs {
+				if stems[fileStem(f)] {
+					count++
+				}
+			}
+			if count > bestCount {
+				best, bestCount = i, count
+			}
+		}
+		if best < 0 || !hasCgoOutputs(actions[best]) {
+			continue
+		}
+		var files []string
+		for _, f := range actions[best] {
+			if path := d.aspectPath(f); !strings.HasPrefix(path, d.sdk.goroot+string(filepath.Separator)) {
+				files = append(files, path)
+			}
+		}
+		pkg.CompiledGoFiles = files
+	}
+}
+
+// hasCgoOutputs reports whether files includes any of the go files cgo
+// generates, like foo.cgo1.go and _cgo_gotypes.go.
+func hasCgoOutputs(files []string) bool {
+	for _, f := range files {
+		if base := filepath.Base(f); strings.HasSuffix(base, ".cgo1.go") || strings.HasPrefix(base, "_cgo_") {
+			return true
+		}
+	}
+	return false
+}
+
+// fileStem returns the base name of filename up to the first dot, so the cgo
+// output foo.cgo1.go has the same stem as foo.go.
+func fileStem(filename string) string {
+	return strings.SplitN(filepath.Base(filename), ".", 2)[0]
+}
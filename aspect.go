@@ -0,0 +1,477 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/derivita/bazelpackagesdriver/pkgconv"
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/xerrors"
+)
+
+// The aspect backend builds an aspect over the requested targets and their deps.
+// The aspect writes one small json file per go target with the information
+// needed for packages.Package, so bazel caches the results and only reruns
+// the actions for targets that have changed.
+const (
+	queryBackend  = "query"
+	aspectBackend = "aspect"
+
+	aspectRepo        = "bazelpackagesdriver_aspect"
+	aspectOutputGroup = "bazelpackagesdriver"
+	aspectName        = "@" + aspectRepo + "//:aspect.bzl%pkginfo_aspect"
+)
+
+// aspectFiles are written to a directory that is used as a local repository
+// with --override_repository. @io_bazel_rules_go is replaced with the name
+// rules_go has in the workspace.
+var aspectFiles = map[string]string{
+	"WORKSPACE": `workspace(name = "` + aspectRepo + `")
+`,
+	"BUILD.bazel": `load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+exports_files(["aspect.bzl"])
+
+go_binary(
+    name = "pkginfo",
+    srcs = ["pkginfo.go"],
+    visibility = ["//visibility:public"],
+)
+`,
+	"aspect.bzl": `load("@io_bazel_rules_go//go:def.bzl", "GoArchive")
+
+PkgInfo = provider(
+    doc = "The bazelpackagesdriver metadata files for a target and its dependencies.",
+    fields = {"files": "depset of json files"},
+)
+
+_DEP_ATTRS = ["actual", "deps", "embed", "library"]
+
+def _dep_targets(ctx):
+    targets = []
+    for name in _DEP_ATTRS:
+        value = getattr(ctx.rule.attr, name, None)
+        if type(value) == "list":
+            targets.extend(value)
+        elif value != None and type(value) == "Target":
+            targets.append(value)
+    return targets
+
+def _pkginfo_aspect_impl(target, ctx):
+    transitive = [dep[PkgInfo].files for dep in _dep_targets(ctx) if PkgInfo in dep]
+    direct = []
+    if GoArchive in target:
+        archive = target[GoArchive]
+        data = archive.data
+        srcs = [f for f in data.srcs if f.extension == "go"]
+        meta = ctx.actions.declare_file(ctx.label.name + ".pkginfo_meta.json")
+        ctx.actions.write(meta, json.encode(struct(
+            label = str(data.label),
+            kind = ctx.rule.kind,
+            importpath = data.importpath,
+            compiled_go_files = [f.path for f in srcs],
+            other_files = [f.path for f in data.orig_srcs if f.extension != "go"],
+            deps = [struct(importpath = d.data.importpath, label = str(d.data.label)) for d in archive.direct],
+        )))
+        out = ctx.actions.declare_file(ctx.label.name + ".pkginfo.json")
+        args = ctx.actions.args()
+        args.add("-meta", meta)
+        args.add("-o", out)
+        args.add_all(srcs)
+        ctx.actions.run(
+            executable = ctx.executable._pkginfo,
+            arguments = [args],
+            inputs = [meta] + srcs,
+            outputs = [out],
+            mnemonic = "GoPackagesDriverInfo",
+        )
+        direct.append(out)
+    files = depset(direct, transitive = transitive)
+    return [PkgInfo(files = files), OutputGroupInfo(` + aspectOutputGroup + ` = files)]
+
+pkginfo_aspect = aspect(
+    implementation = _pkginfo_aspect_impl,
+    attr_aspects = _DEP_ATTRS,
+    attrs = {
+        "_pkginfo": attr.label(
+            default = Label("//:pkginfo"),
+            executable = True,
+            cfg = "exec",
+        ),
+    },
+)
+`,
+	"pkginfo.go": `// pkginfo adds the package name and imports of each source file to the
+// metadata written by the bazelpackagesdriver aspect.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"strconv"
+)
+
+type file struct {
+	Path    string   ` + "`json:\"path\"`" + `
+	Package string   ` + "`json:\"package,omitempty\"`" + `
+	Imports []string ` + "`json:\"imports,omitempty\"`" + `
+	Error   string   ` + "`json:\"error,omitempty\"`" + `
+}
+
+func main() {
+	meta := flag.String("meta", "", "metadata written by the aspect")
+	out := flag.String("o", "", "output file")
+	flag.Parse()
+
+	data, err := ioutil.ReadFile(*meta)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		log.Fatal(err)
+	}
+
+	var files []file
+	fset := token.NewFileSet()
+	for _, src := range flag.Args() {
+		f := file{Path: src}
+		if syntax, err := parser.ParseFile(fset, src, nil, parser.ImportsOnly); err != nil {
+			f.Error = err.Error()
+		} else {
+			f.Package = syntax.Name.Name
+			for _, i := range syntax.Imports {
+				if path, err := strconv.Unquote(i.Path.Value); err == nil {
+					f.Imports = append(f.Imports, path)
+				}
+			}
+		}
+		files = append(files, f)
+	}
+	info["files"] = files
+
+	if data, err = json.Marshal(info); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*out, data, 0666); err != nil {
+		log.Fatal(err)
+	}
+}
+`,
+}
+
+// aspectPackage is the json written by the aspect for each target.
+type aspectPackage struct {
+	Label           string   `json:"label"`
+	Kind            string   `json:"kind"`
+	ImportPath      string   `json:"importpath"`
+	CompiledGoFiles []string `json:"compiled_go_files"`
+	OtherFiles      []string `json:"other_files"`
+	Deps            []struct {
+		ImportPath string `json:"importpath"`
+		Label      string `json:"label"`
+	} `json:"deps"`
+	Files []struct {
+		Path    string   `json:"path"`
+		Package string   `json:"package"`
+		Imports []string `json:"imports"`
+		Error   string   `json:"error"`
+	} `json:"files"`
+}
+
+// packagesFromAspect is the aspect backend's equivalent of packagesFromQueries.
+// bazel query is only used to find the root targets, everything else comes from
+// the aspect outputs.
+func (d *bazelDriver) packagesFromAspect(queries []string) (pkgs []*packages.Package, roots []string, err error) {
+	query := d.goFilter(strings.Join(queries, "+"))
+	results, err := d.query(query)
+	if err != nil {
+		return
+	}
+	labels := d.aspectTargets(results)
+	if len(labels) == 0 {
+		return
+	}
+	d.resolveAliases(d.aliasTargets(results))
+
+	rulesGo, err := d.rulesGoRepo()
+	if err != nil {
+		return
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return
+	}
+	dir, err := writeAspectRepo(filepath.Join(cache, "bazelpackagesdriver"), rulesGo)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("writeAspectRepo: %w", err)
+	}
+	flags := []string{
+		fmt.Sprintf("--override_repository=%v=%v", aspectRepo, dir),
+		"--aspects=" + aspectName,
+	}
+	log.Printf("bazel build %v for %v targets", aspectName, len(labels))
+	outputs, err := d.buildOutputGroup(aspectOutputGroup, flags, labels)
+	if err != nil {
+		return
+	}
+
+	rootLabels := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		rootLabels[l] = true
+	}
+	seen := make(map[string]bool)
+	for _, files := range outputs {
+		for _, f := range files {
+			if seen[f] {
+				continue
+			}
+			seen[f] = true
+			var info aspectPackage
+			data, err := ioutil.ReadFile(f)
+			if err == nil {
+				err = json.Unmarshal(data, &info)
+			}
+			if err != nil {
+				return nil, nil, xerrors.Errorf("reading %v: %w", f, err)
+			}
+			info.Label = normalizeLabel(info.Label)
+			if !rootLabels[info.Label] && d.cfg.Mode&packages.NeedDeps == 0 {
+				continue
+			}
+			for _, pkg := range d.aspectToPackages(&info) {
+				pkgs = append(pkgs, pkg)
+				if rootLabels[info.Label] || d.includeInRoots(pkg) {
+					roots = append(roots, pkg.ID)
+				}
+			}
+		}
+	}
+	// The aspect can't see unsaved files, so their imports are missing.
+	d.addOverlayFiles(pkgs)
+	return
+}
+
+// aspectTargets returns the labels of the rules in result that the aspect is
+// built for: the go rules and aliases, and like the query backend, custom
+// kinds from the config and rule classes registered with pkgconv.Register.
+func (d *bazelDriver) aspectTargets(result *blaze_query.QueryResult) []string {
+	registered := make(map[string]bool)
+	for _, class := range pkgconv.Registered() {
+		registered[class] = true
+	}
+	var labels []string
+	for _, t := range result.GetTarget() {
+		rule := t.GetRule()
+		if rule == nil {
+			continue
+		}
+		class := d.kinds.RuleClass(rule.GetRuleClass())
+		if strings.HasPrefix(class, "go_") || class == "alias" || registered[rule.GetRuleClass()] {
+			labels = append(labels, rule.GetName())
+		}
+	}
+	return labels
+}
+
+// aspectToPackages converts the aspect output into packages.
+// Like pkgconv, go_test targets are split into the internal and external test packages.
+func (d *bazelDriver) aspectToPackages(info *aspectPackage) []*packages.Package {
+	deps := make(map[string]string, len(info.Deps))
+	for _, dep := range info.Deps {
+		deps[dep.ImportPath] = normalizeLabel(dep.Label)
+	}
+	names := make(map[string]string, len(info.Files))
+	imports := make(map[string][]string, len(info.Files))
+	for _, f := range info.Files {
+		if f.Error != "" {
+			log.Printf("%v: %v", f.Path, f.Error)
+		}
+		names[f.Path] = f.Package
+		imports[f.Path] = f.Imports
+	}
+
+	// Custom kinds that are like go_test are split up too.
+	kind := d.kinds.RuleClass(info.Kind)
+	ctxt := pkgconv.BuildContext(&d.cfg)
+	var ignored []string
+	var internal, external *packages.Package
+	for _, src := range info.CompiledGoFiles {
+		if path := d.aspectPath(src); !pkgconv.MatchFile(ctxt, path) {
+			ignored = append(ignored, path)
+			continue
+		}
+		pkg := &internal
+		if kind == "go_test" && strings.HasSuffix(names[src], "_test") {
+			pkg = &external
+		}
+		if *pkg == nil {
+			*pkg = &packages.Package{
+				ID:      info.Label,
+				PkgPath: info.ImportPath,
+				Name:    names[src],
+				Imports: make(map[string]*packages.Package),
+			}
+		}
+		(*pkg).CompiledGoFiles = append((*pkg).CompiledGoFiles, d.aspectPath(src))
+		for _, i := range imports[src] {
+			if d.sdk.packages[i] {
+				(*pkg).Imports[i] = &packages.Package{ID: i}
+				d.stdlibImports[i] = true
+			} else if label, ok := deps[i]; ok {
+				(*pkg).Imports[i] = &packages.Package{ID: label}
+			}
+		}
+	}
+
+	if len(ignored) > 0 {
+		if internal == nil && external == nil {
+			internal = &packages.Package{
+				ID:      info.Label,
+				PkgPath: info.ImportPath,
+				Name:    names[info.CompiledGoFiles[0]],
+				Imports: make(map[string]*packages.Package),
+			}
+		}
+		if internal != nil {
+			internal.IgnoredFiles = ignored
+		} else {
+			external.IgnoredFiles = ignored
+		}
+	}
+
+	var pkgs []*packages.Package
+	if internal != nil {
+		if kind == "go_test" {
+			internal.ID = fmt.Sprintf("%s [%s]", internal.PkgPath, info.Label)
+		}
+		for _, f := range info.OtherFiles {
+			internal.OtherFiles = append(internal.OtherFiles, d.aspectPath(f))
+		}
+		pkgs = append(pkgs, internal)
+	}
+	if external != nil {
+		external.PkgPath += "_test"
+		external.ID = fmt.Sprintf("%s [%s]", external.PkgPath, info.Label)
+		if internal != nil {
+			external.Imports[internal.PkgPath] = &packages.Package{ID: internal.ID}
+		}
+		pkgs = append(pkgs, external)
+	}
+	for _, pkg := range pkgs {
+		pkg.GoFiles = pkg.CompiledGoFiles
+	}
+	return pkgs
+}
+
+// aspectPath converts an execroot relative path from the aspect or aquery into an absolute path.
+// Sources from the main workspace use the workspace path, so they match the files open in the editor.
+func (d *bazelDriver) aspectPath(path string) string {
+	if strings.HasPrefix(path, "bazel-out/") || strings.HasPrefix(path, "external/") {
+		return filepath.Join(d.execRoot, path)
+	}
+	return filepath.Join(d.workspaceRoot, path)
+}
+
+// normalizeLabel removes the repository from labels in the main repository.
+// Depending on the bazel version str(Label) may use //, @// or @@//.
+func normalizeLabel(label string) string {
+	if strings.HasPrefix(label, "@@//") {
+		return label[2:]
+	} else if strings.HasPrefix(label, "@//") {
+		return label[1:]
+	}
+	return label
+}
+
+// rulesGoRepos are the names rules_go may be visible as: io_bazel_rules_go in
+// WORKSPACE setups, and rules_go with bzlmod.
+var rulesGoRepos = []string{"@io_bazel_rules_go", "@rules_go"}
+
+// rulesGoRepo returns the name of the rules_go repository in the workspace.
+func (d *bazelDriver) rulesGoRepo() (string, error) {
+	var err error
+	for _, repo := range rulesGoRepos {
+		var result *blaze_query.QueryResult
+		if result, err = d.query(repo + "//go:def.bzl"); err != nil {
+			continue
+		}
+		if len(result.GetTarget()) == 0 {
+			err = fmt.Errorf("no def.bzl in %v", repo)
+			continue
+		}
+		return repo, nil
+	}
+	return "", fmt.Errorf("couldn't find the rules_go repository: %w", err)
+}
+
+// writeAspectRepo writes aspectFiles to a directory in parent, loading rules_go
+// from rulesGo, and returns the directory.
+// The name of the directory has a hash of the files. It's written to a
+// temporary directory that is renamed when it's complete, so concurrent drivers
+// don't see a partially written repository.
+func writeAspectRepo(parent, rulesGo string) (string, error) {
+	files := make(map[string]string, len(aspectFiles))
+	var names []string
+	for name, contents := range aspectFiles {
+		files[name] = strings.ReplaceAll(contents, "@io_bazel_rules_go", rulesGo)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\x00%s\x00", name, files[name])
+	}
+	dir := filepath.Join(parent, fmt.Sprintf("%v-%x", aspectRepo, hash.Sum(nil)[:8]))
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+	if err := os.MkdirAll(parent, 0777); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(parent, aspectRepo)
+	if err != nil {
+		return "", err
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), []byte(contents), 0666); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		// Another driver may have written it first.
+		if _, statErr := os.Stat(dir); statErr == nil {
+			return dir, nil
+		}
+		return "", err
+	}
+	return dir, nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/tools/go/packages"
+)
+
+// Bazel is the set of bazel commands used by the driver.
+// Tests replace it with a fake that returns canned results.
+type Bazel interface {
+	Info() (map[string]string, error)
+	// BazelBin returns the bazel-bin directory for the build flags.
+	BazelBin() (string, error)
+	// Query returns the result of bazel query. If bazel reports errors but
+	// still returns a partial result, the error is a *queryError.
+	Query(args ...string) (*blaze_query.QueryResult, error)
+	// AQuery returns the raw output of bazel aquery.
+	AQuery(args ...string) ([]byte, error)
+	Build(args ...string) (*bytes.Buffer, error)
+}
+
+// bazelClient runs bazel in the current directory.
+type bazelClient struct {
+	bin          string
+	startupFlags []string
+	queryFlags   []string
+	buildFlags   []string
+}
+
+func newBazel(c *config) Bazel {
+	b := bazelClient{
+		bin:          c.Bazel,
+		startupFlags: c.StartupFlags,
+		queryFlags:   c.QueryFlags,
+		buildFlags:   c.BuildFlags,
+	}
+	if b.bin == "" {
+		b.bin = findBazel()
+	}
+	if c.OutputBase != "" {
+		b.startupFlags = append(append([]string(nil), b.startupFlags...), "--output_base="+c.OutputBase)
+		// The bazel-* symlinks in the workspace belong to the user's builds.
+		b.buildFlags = append(append([]string(nil), b.buildFlags...), "--symlink_prefix=/")
+	}
+	return b
+}
+
+// command returns the command that runs bazel with the startup flags and
+// then the command flags before args.
+func (b bazelClient) command(command string, flags []string, args ...string) *exec.Cmd {
+	cmdArgs := append(append([]string(nil), b.startupFlags...), command)
+	cmdArgs = append(append(cmdArgs, flags...), args...)
+	return exec.Command(b.bin, cmdArgs...)
+}
+
+// Info returns the output of bazel info.
+func (b bazelClient) Info() (map[string]string, error) {
+	var stdout bytes.Buffer
+	cmd := b.command("info", nil)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	info := make(map[string]string)
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if kv := strings.SplitN(line, ": ", 2); len(kv) == 2 {
+			info[kv[0]] = kv[1]
+		}
+	}
+	return info, nil
+}
+
+// BazelBin runs bazel info bazel-bin with the build flags, which choose the
+// configuration and so the output directory.
+func (b bazelClient) BazelBin() (string, error) {
+	var stdout bytes.Buffer
+	cmd := b.command("info", b.buildFlags, "bazel-bin")
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Build runs bazel build and returns its output.
+func (b bazelClient) Build(args ...string) (*bytes.Buffer, error) {
+	var output bytes.Buffer
+	cmd := b.command("build", b.buildFlags, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = io.MultiWriter(os.Stderr, &output)
+	err := cmd.Run()
+	return &output, err
+}
+
+func (b bazelClient) AQuery(args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := b.command("aquery", b.buildFlags, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	return stdout.Bytes(), err
+}
+
+// partialExitCode is the exit code of bazel query with --keep_going when
+// there were errors, but the output has the targets that could be loaded.
+const partialExitCode = 3
+
+// Query runs bazel query with --keep_going, so an error in one BUILD file
+// doesn't hide the rest of the workspace.
+func (b bazelClient) Query(args ...string) (*blaze_query.QueryResult, error) {
+	var stdout, stderr bytes.Buffer
+	flags := append([]string{"--output=proto", "--order_output=no", "--color=no", "--keep_going"}, b.queryFlags...)
+	cmd := b.command("query", flags, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	runErr := cmd.Run()
+	errs := parseQueryErrors(stderr.Bytes())
+	if runErr != nil && cmd.ProcessState.ExitCode() != partialExitCode {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("%v: %v", runErr, &queryError{errs})
+		}
+		return nil, runErr
+	}
+	var result blaze_query.QueryResult
+	if err := proto.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return nil, err
+	}
+	if runErr != nil {
+		return &result, &queryError{errs}
+	}
+	return &result, nil
+}
+
+// queryError is the error bazel query returns along with a partial result.
+type queryError struct {
+	errs []packages.Error
+}
+
+func (e *queryError) Error() string {
+	var msgs []string
+	for _, err := range e.errs {
+		msgs = append(msgs, err.Error())
+	}
+	if len(msgs) == 0 {
+		return "bazel query returned a partial result"
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// queryErrorPattern matches the errors bazel prints for BUILD and .bzl files,
+// like "ERROR: /ws/foo/BUILD.bazel:3:11: no such target '//bar:baz'".
+var queryErrorPattern = regexp.MustCompile(`^ERROR: (.+:\d+:\d+): (.*)$`)
+
+// parseQueryErrors returns the errors in the stderr of bazel query.
+// Errors that don't have a location have an empty Pos.
+func parseQueryErrors(stderr []byte) []packages.Error {
+	var errs []packages.Error
+	scanner := bufio.NewScanner(bytes.NewReader(stderr))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := queryErrorPattern.FindStringSubmatch(line); m != nil {
+			errs = append(errs, packages.Error{Pos: m[1], Msg: m[2], Kind: packages.ListError})
+		} else if strings.HasPrefix(line, "ERROR: ") {
+			errs = append(errs, packages.Error{Msg: strings.TrimPrefix(line, "ERROR: "), Kind: packages.ListError})
+		}
+	}
+	return errs
+}
+
+// findBazel looks for bazelisk or bazel in $PATH.
+func findBazel() string {
+	if path, err := exec.LookPath("bazelisk"); err == nil {
+		return path
+	}
+	if path, err := exec.LookPath("bazel"); err == nil {
+		return path
+	}
+	return "bazel"
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/tools/go/packages"
+)
+
+// fakeBazel is a Bazel that returns canned results, so tests don't need a bazel installation.
+type fakeBazel struct {
+	info    map[string]string
+	queries map[string][]*blaze_query.Target
+	// errors are returned with the result of a query, like bazel query --keep_going.
+	errors map[string][]packages.Error
+	aquery []byte
+	builds [][]string
+	// events are written to the --build_event_json_file of a build.
+	events string
+	// bazelBins counts the calls to BazelBin.
+	bazelBins int
+	// ran are the queries that were run, other than buildfiles().
+	ran []string
+}
+
+func (b *fakeBazel) Info() (map[string]string, error) {
+	if b.info == nil {
+		return nil, fmt.Errorf("not a bazel workspace")
+	}
+	return b.info, nil
+}
+
+func (b *fakeBazel) BazelBin() (string, error) {
+	b.bazelBins++
+	return b.info["bazel-bin"], nil
+}
+
+func (b *fakeBazel) Query(args ...string) (*blaze_query.QueryResult, error) {
+	query := strings.Join(args, " ")
+	if strings.HasPrefix(query, "buildfiles(") {
+		return &blaze_query.QueryResult{}, nil
+	}
+	b.ran = append(b.ran, query)
+	targets, ok := b.queries[query]
+	if !ok {
+		return nil, fmt.Errorf("unexpected query %#v", query)
+	}
+	if errs := b.errors[query]; len(errs) > 0 {
+		return &blaze_query.QueryResult{Target: targets}, &queryError{errs}
+	}
+	return &blaze_query.QueryResult{Target: targets}, nil
+}
+
+func (b *fakeBazel) AQuery(args ...string) ([]byte, error) {
+	if b.aquery == nil {
+		return nil, fmt.Errorf("unexpected aquery %v", args)
+	}
+	return b.aquery, nil
+}
+
+func (b *fakeBazel) Build(args ...string) (*bytes.Buffer, error) {
+	b.builds = append(b.builds, args)
+	for _, arg := range args {
+		if filename := strings.TrimPrefix(arg, "--build_event_json_file="); filename != arg {
+			if err := ioutil.WriteFile(filename, []byte(b.events), 0666); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &bytes.Buffer{}, nil
+}
+
+func rule(class, name, location string, attrs ...*blaze_query.Attribute) *blaze_query.Target {
+	return &blaze_query.Target{
+		Type: blaze_query.Target_RULE.Enum(),
+		Rule: &blaze_query.Rule{
+			Name:      proto.String(name),
+			RuleClass: proto.String(class),
+			Location:  proto.String(location),
+			Attribute: attrs,
+		},
+	}
+}
+
+func sourceFile(name, location string) *blaze_query.Target {
+	return &blaze_query.Target{
+		Type: blaze_query.Target_SOURCE_FILE.Enum(),
+		SourceFile: &blaze_query.SourceFile{
+			Name:     proto.String(name),
+			Location: proto.String(location),
+		},
+	}
+}
+
+func stringAttr(name, value string) *blaze_query.Attribute {
+	return &blaze_query.Attribute{
+		Name:        proto.String(name),
+		Type:        blaze_query.Attribute_STRING.Enum(),
+		StringValue: proto.String(value),
+	}
+}
+
+func listAttr(name string, values ...string) *blaze_query.Attribute {
+	return &blaze_query.Attribute{
+		Name:            proto.String(name),
+		Type:            blaze_query.Attribute_LABEL_LIST.Enum(),
+		StringListValue: values,
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	stderr := `Loading: 0 packages loaded
+ERROR: /ws/foo/BUILD.bazel:3:11: no such target '//bar:baz': target 'baz' not declared in package 'bar'
+ERROR: /ws/bar/BUILD:7:1: syntax error at 'go_library': expected ,
+ERROR: Evaluation of query "deps(//...)" failed: errors were encountered while computing transitive closure
+WARNING: --keep_going specified, ignoring errors.  Results may be inaccurate
+`
+	want := []packages.Error{
+		{Pos: "/ws/foo/BUILD.bazel:3:11", Msg: "no such target '//bar:baz': target 'baz' not declared in package 'bar'", Kind: packages.ListError},
+		{Pos: "/ws/bar/BUILD:7:1", Msg: "syntax error at 'go_library': expected ,", Kind: packages.ListError},
+		{Msg: `Evaluation of query "deps(//...)" failed: errors were encountered while computing transitive closure`, Kind: packages.ListError},
+	}
+	if got := parseQueryErrors([]byte(stderr)); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseQueryErrors() = %v, want %v", got, want)
+	}
+}
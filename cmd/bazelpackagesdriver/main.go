@@ -15,10 +15,32 @@
 package main
 
 import (
+	"log"
+	"os"
+
 	"github.com/derivita/bazelpackagesdriver"
 	"github.com/derivita/bazelpackagesdriver/driver"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
 	driver.Run(bazelpackagesdriver.New())
 }
+
+// serve runs the daemon: bazelpackagesdriver serve [socket]
+func serve(args []string) {
+	var socket string
+	if len(args) > 0 {
+		socket = args[0]
+	} else {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatal(err)
+		}
+		socket = driver.SocketPath(wd)
+	}
+	log.Fatal(driver.Serve(bazelpackagesdriver.New(), socket))
+}
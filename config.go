@@ -0,0 +1,142 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"github.com/derivita/bazelpackagesdriver/pkgconv"
+)
+
+// configFile is the name of the driver's config file in the workspace root.
+const configFile = ".bazelpackagesdriver.json"
+
+// config is how the driver runs bazel. It's read from configFile, and the
+// environment variables in the request override it.
+type config struct {
+	// Bazel is the bazel binary. The default is bazelisk or bazel from $PATH.
+	Bazel string `json:"bazel,omitempty"`
+	// StartupFlags are passed to every bazel command, before the command name.
+	StartupFlags []string `json:"startup_flags,omitempty"`
+	// OutputBase is an output base for the driver's own bazel server, so
+	// loading packages doesn't wait for the user's builds or replace their
+	// outputs. Relative paths are relative to the workspace root.
+	OutputBase string `json:"output_base,omitempty"`
+	// QueryFlags are passed to bazel query.
+	QueryFlags []string `json:"query_flags,omitempty"`
+	// BuildFlags are passed to bazel build and aquery.
+	BuildFlags []string `json:"build_flags,omitempty"`
+	// Kinds are custom rules and macros that are converted like rules_go rules.
+	Kinds pkgconv.RuleKinds `json:"kinds,omitempty"`
+}
+
+// loadConfig returns the config for requests from dir.
+// The config file is looked for in the workspace root containing dir.
+func loadConfig(cfg *driver.Request, dir string) (*config, error) {
+	c := &config{}
+	root := driver.WorkspaceRoot(dir)
+	if root != "" {
+		data, err := ioutil.ReadFile(filepath.Join(root, configFile))
+		if err == nil {
+			if err := json.Unmarshal(data, c); err != nil {
+				return nil, fmt.Errorf("%v: %w", filepath.Join(root, configFile), err)
+			}
+			if err := c.Kinds.Validate(); err != nil {
+				return nil, fmt.Errorf("%v: %w", filepath.Join(root, configFile), err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	c.Bazel = driver.GetEnv(cfg, "GOPACKAGESDRIVER_BAZEL", c.Bazel)
+	c.OutputBase = driver.GetEnv(cfg, "GOPACKAGESDRIVER_OUTPUT_BASE", c.OutputBase)
+	if flags := driver.GetEnv(cfg, "GOPACKAGESDRIVER_BAZEL_STARTUP_FLAGS", ""); flags != "" {
+		c.StartupFlags = strings.Fields(flags)
+	}
+	if flags := driver.GetEnv(cfg, "GOPACKAGESDRIVER_BAZEL_QUERY_FLAGS", ""); flags != "" {
+		c.QueryFlags = strings.Fields(flags)
+	}
+	if flags := driver.GetEnv(cfg, "GOPACKAGESDRIVER_BAZEL_BUILD_FLAGS", ""); flags != "" {
+		c.BuildFlags = strings.Fields(flags)
+	}
+	// Bazel flags in the request, for example from the gopls buildFlags setting,
+	// come after the configured flags, so they take precedence.
+	bazelFlags, _ := splitBuildFlags(cfg.BuildFlags)
+	c.QueryFlags = append(c.QueryFlags, queryFlags(bazelFlags)...)
+	c.BuildFlags = append(c.BuildFlags, bazelFlags...)
+	if c.OutputBase != "" && !filepath.IsAbs(c.OutputBase) && root != "" {
+		c.OutputBase = filepath.Join(root, c.OutputBase)
+	}
+	return c, nil
+}
+
+// splitBuildFlags separates the build flags in a request into the flags for
+// bazel and the flags for the go command. The go command's flags are written
+// with a single dash, like -tags=foo, so flags that start with -- are for
+// bazel, except for --tags, which is changed to -tags. Bazel flags need to use
+// the --flag=value form.
+func splitBuildFlags(flags []string) (bazelFlags, goFlags []string) {
+	for i := 0; i < len(flags); i++ {
+		flag := flags[i]
+		switch {
+		case (flag == "--tags" || flag == "-tags") && i+1 < len(flags):
+			goFlags = append(goFlags, "-tags", flags[i+1])
+			i++
+		case strings.HasPrefix(flag, "--tags="):
+			goFlags = append(goFlags, strings.TrimPrefix(flag, "-"))
+		case strings.HasPrefix(flag, "--"):
+			bazelFlags = append(bazelFlags, flag)
+		default:
+			goFlags = append(goFlags, flag)
+		}
+	}
+	return bazelFlags, goFlags
+}
+
+// loadingFlags are the bazel flags that bazel query accepts, and that can
+// change which targets exist. The other build flags only change the
+// configuration, which bazel query doesn't use, and bazel query rejects many
+// of them.
+var loadingFlags = map[string]bool{
+	"--config":              true,
+	"--deleted_packages":    true,
+	"--package_path":        true,
+	"--override_repository": true,
+	"--override_module":     true,
+	"--registry":            true,
+	"--repo_env":            true,
+	"--enable_bzlmod":       true,
+	"--noenable_bzlmod":     true,
+	"--enable_workspace":    true,
+	"--noenable_workspace":  true,
+}
+
+// queryFlags returns the flags from bazelFlags that are passed to bazel query.
+func queryFlags(bazelFlags []string) []string {
+	var result []string
+	for _, flag := range bazelFlags {
+		if loadingFlags[strings.SplitN(flag, "=", 2)[0]] {
+			result = append(result, flag)
+		}
+	}
+	return result
+}
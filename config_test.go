@@ -0,0 +1,139 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/derivita/bazelpackagesdriver/driver"
+)
+
+func TestLoadConfig(t *testing.T) {
+	root := testWorkspace(t)
+	data := `{
+	"bazel": "/usr/local/bin/bazel",
+	"startup_flags": ["--host_jvm_args=-Xmx2g"],
+	"output_base": ".cache/driver",
+	"query_flags": ["--noimplicit_deps"]
+}`
+	if err := ioutil.WriteFile(filepath.Join(root, configFile), []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &driver.Request{Env: []string{"GOPACKAGESDRIVER_BAZEL_BUILD_FLAGS=--config=linux --define=x=y"}}
+	c, err := loadConfig(cfg, filepath.Join(root, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &config{
+		Bazel:        "/usr/local/bin/bazel",
+		StartupFlags: []string{"--host_jvm_args=-Xmx2g"},
+		OutputBase:   filepath.Join(root, ".cache/driver"),
+		QueryFlags:   []string{"--noimplicit_deps"},
+		BuildFlags:   []string{"--config=linux", "--define=x=y"},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("loadConfig() = %+v, want %+v", c, want)
+	}
+
+	b := newBazel(c).(bazelClient)
+	cmd := b.command("build", b.buildFlags, "//foo")
+	wantArgs := []string{
+		"/usr/local/bin/bazel",
+		"--host_jvm_args=-Xmx2g",
+		"--output_base=" + filepath.Join(root, ".cache/driver"),
+		"build",
+		"--config=linux",
+		"--define=x=y",
+		"--symlink_prefix=/",
+		"//foo",
+	}
+	if !reflect.DeepEqual(cmd.Args, wantArgs) {
+		t.Errorf("build args = %q, want %q", cmd.Args, wantArgs)
+	}
+}
+
+func TestLoadConfigOverride(t *testing.T) {
+	root := testWorkspace(t)
+	if err := ioutil.WriteFile(filepath.Join(root, configFile), []byte(`{"output_base": "/a"}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &driver.Request{Env: []string{"GOPACKAGESDRIVER_OUTPUT_BASE=/b"}}
+	c, err := loadConfig(cfg, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.OutputBase != "/b" {
+		t.Errorf("OutputBase = %v, want /b", c.OutputBase)
+	}
+}
+
+func TestSplitBuildFlags(t *testing.T) {
+	flags := []string{"-tags=foo", "--config=linux", "--define=x=y", "--tags", "bar", "--tags=baz", "-mod=mod", "--deleted_packages=//x",
+		"--incompatible_strict_action_env", "--noenable_bzlmod", "--config_setting_visibility_policy=off"}
+	bazel, gocmd := splitBuildFlags(flags)
+	if want := []string{"--config=linux", "--define=x=y", "--deleted_packages=//x", "--incompatible_strict_action_env", "--noenable_bzlmod", "--config_setting_visibility_policy=off"}; !reflect.DeepEqual(bazel, want) {
+		t.Errorf("bazel flags = %q, want %q", bazel, want)
+	}
+	if want := []string{"-tags=foo", "-tags", "bar", "-tags=baz", "-mod=mod"}; !reflect.DeepEqual(gocmd, want) {
+		t.Errorf("go flags = %q, want %q", gocmd, want)
+	}
+	if got, want := queryFlags(bazel), []string{"--config=linux", "--deleted_packages=//x", "--noenable_bzlmod"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queryFlags() = %q, want %q", got, want)
+	}
+}
+
+func TestLoadConfigRequestFlags(t *testing.T) {
+	root := testWorkspace(t)
+	cfg := &driver.Request{
+		Env:        []string{"GOPACKAGESDRIVER_BAZEL_BUILD_FLAGS=--keep_going"},
+		BuildFlags: []string{"-tags=foo", "--config=linux", "--define=x=y"},
+	}
+	c, err := loadConfig(cfg, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"--config=linux"}; !reflect.DeepEqual(c.QueryFlags, want) {
+		t.Errorf("QueryFlags = %q, want %q", c.QueryFlags, want)
+	}
+	if want := []string{"--keep_going", "--config=linux", "--define=x=y"}; !reflect.DeepEqual(c.BuildFlags, want) {
+		t.Errorf("BuildFlags = %q, want %q", c.BuildFlags, want)
+	}
+}
+
+func TestLoadConfigKinds(t *testing.T) {
+	root := testWorkspace(t)
+	data := `{"kinds": {"company.go_library": {"like": "library", "attrs": {"srcs": "go_srcs"}}}}`
+	if err := ioutil.WriteFile(filepath.Join(root, configFile), []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(&driver.Request{}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &bazelDriver{kinds: c.Kinds}
+	if got, want := d.goFilter("//..."), `kind("alias|proto_library|go_|company\.go_library", //...)`; got != want {
+		t.Errorf("goFilter() = %v, want %v", got, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, configFile), []byte(`{"kinds": {"x": {"like": "macro"}}}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(&driver.Request{}, root); err == nil {
+		t.Error("loadConfig() accepted an unknown behavior")
+	}
+}
@@ -17,8 +17,8 @@ package bazelpackagesdriver
 
 import (
 	"fmt"
-	"go/ast"
 	"go/parser"
+	"go/scanner"
 	"go/token"
 	"go/types"
 	"log"
@@ -29,7 +29,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/bazelbuild/bazel-watcher/bazel"
 	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
 	"github.com/derivita/bazelpackagesdriver/driver"
 	"github.com/derivita/bazelpackagesdriver/pkgconv"
@@ -39,54 +38,116 @@ import (
 
 const fileQueryPrefix = "file="
 
-var gorootPattern = regexp.MustCompile(`^bazel-[^/]+/external/go_sdk\b`)
+// cgoImports are the packages imported by the code cgo generates.
+var cgoImports = []string{`"runtime/cgo"`, `"syscall"`, `"unsafe"`}
 
-const supportedModes = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedDeps | packages.NeedTypesSizes | packages.NeedModule
+const supportedModes = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedDeps | packages.NeedTypesSizes | packages.NeedModule | packages.NeedExportsFile | typecheckModes
+
+// typecheckModes are handled by go/packages itself: it parses and type checks
+// the CompiledGoFiles in dependency order after the driver returns, or loads
+// the ExportFile of dependencies. So the driver only needs to return the full import graph.
+const typecheckModes = packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo
+
+// typecheckDeps are the modes go/packages needs to type check from source.
+const typecheckDeps = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedDeps | packages.NeedTypesSizes
 
 type bazelDriver struct {
 	cfg           driver.Request
 	resp          driver.Response
-	bazel         bazel.Bazel
+	bazel         Bazel
+	ws            *workspace
 	sdk           *gosdk
 	workspaceRoot string
+	execRoot      string
+	// wd is the directory the driver runs in, which relative patterns are relative to.
+	wd            string
+	backend       string
 	stdlibImports map[string]bool
 	fileQueries   map[string]bool
 	importQueries map[string]bool
-	wildcardQuery bool
+	// importPatterns match the import paths of the roots for patterns with ...
+	importPatterns []*regexp.Regexp
+	// labelQueries are the labels of the targets from label patterns.
+	labelQueries map[string]bool
+	// packageQueries are the bazel packages from directory and label patterns. Packages
+	// ending in /... include the packages under them.
+	packageQueries map[string]bool
+	// allQuery is set by the all pattern, which makes every package a root.
+	allQuery bool
+	kinds    pkgconv.RuleKinds
+	// queryErrors are the errors bazel reported in BUILD files during this request.
+	queryErrors []packages.Error
+	// overlayFiles are the files from file= patterns that only exist in the
+	// overlay, and the bazel package for their directory.
+	overlayFiles map[string]string
 }
 
 // New returns a Driver implementation based on bazel query.
+// The driver keeps the bazel info, query results and parsed files for each
+// directory it's called from, so they can be reused by later requests.
+// They're kept in memory when it's running as a daemon, and saved in the
+// user cache directory.
 func New() driver.Driver {
+	return newDriver(newBazel)
+}
+
+// newDriver returns a Driver that runs bazel with a new client from newBazel for each request.
+func newDriver(newBazel func(*config) Bazel) driver.Driver {
+	var cache workspaces
 	return func(cfg driver.Request, patterns ...string) (*driver.Response, error) {
-		bzl := bazel.New()
-		sdk, err := newGoSDK(bzl)
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		c, err := loadConfig(&cfg, wd)
+		if err != nil {
+			return nil, err
+		}
+		bzl := newBazel(c)
+		ws, err := cache.get(wd, &cfg, c, bzl)
 		if err != nil {
 			return nil, err
+		} else if ws == nil {
+			return &driver.Response{NotHandled: true}, nil
 		}
 		driver := &bazelDriver{
-			cfg:           cfg,
-			bazel:         bzl,
-			sdk:           sdk,
-			stdlibImports: make(map[string]bool),
-			fileQueries:   make(map[string]bool),
-			importQueries: make(map[string]bool),
+			cfg:            cfg,
+			bazel:          bzl,
+			ws:             ws,
+			sdk:            ws.sdk,
+			workspaceRoot:  ws.Root,
+			execRoot:       ws.ExecRoot,
+			stdlibImports:  make(map[string]bool),
+			fileQueries:    make(map[string]bool),
+			importQueries:  make(map[string]bool),
+			packageQueries: make(map[string]bool),
+			labelQueries:   make(map[string]bool),
+			overlayFiles:   make(map[string]string),
+			wd:             wd,
+			backend:        driver.GetEnv(&cfg, "GOPACKAGESDRIVER_BACKEND", queryBackend),
+			kinds:          c.Kinds,
+		}
+		resp, err := driver.loadPackages(patterns...)
+		if err := ws.save(); err != nil {
+			log.Printf("couldn't save cache: %v", err)
 		}
-		return driver.loadPackages(patterns...)
+		return resp, err
 	}
 }
 
 func (d *bazelDriver) loadPackages(patterns ...string) (*driver.Response, error) {
-	if info, err := d.bazel.Info(); err != nil {
-		return &driver.Response{NotHandled: true}, nil
-	} else {
-		d.workspaceRoot = info["workspace"]
-	}
-
 	log.Printf("mode: %v", d.cfg.Mode)
 	unsupportedModes := d.cfg.Mode &^ supportedModes
 	if unsupportedModes != 0 {
 		return nil, fmt.Errorf("%v (%b) not implemented", unsupportedModes, unsupportedModes)
 	}
+	if usesExportData(d.cfg.Mode) {
+		d.cfg.Mode |= packages.NeedExportsFile
+	}
+	if d.cfg.Mode&typecheckModes != 0 {
+		// go/packages needs the whole graph, even if it only loads export data for the dependencies.
+		d.cfg.Mode |= typecheckDeps
+	}
 
 	if len(patterns) == 0 {
 		patterns = append(patterns, ".")
@@ -95,6 +156,7 @@ func (d *bazelDriver) loadPackages(patterns ...string) (*driver.Response, error)
 	var queries []string
 
 	var ignoredPkg packages.Package
+	var patternErrors []*packages.Package
 
 	stdlibRoot := filepath.Join(d.sdk.goroot, "src")
 
@@ -118,7 +180,7 @@ func (d *bazelDriver) loadPackages(patterns ...string) (*driver.Response, error)
 					fp = rel
 				}
 			}
-			if prefix := gorootPattern.FindString(fp); prefix != "" {
+			if prefix := d.sdk.gorootPrefix(fp); prefix != "" {
 				ignoredPkg.Name = prefix
 				ignoredPkg.ID = prefix
 				ignoredPkg.IgnoredFiles = append(ignoredPkg.IgnoredFiles, fp)
@@ -126,22 +188,62 @@ func (d *bazelDriver) loadPackages(patterns ...string) (*driver.Response, error)
 			}
 			query, err := d.convertFileQuery(fp)
 			if err != nil {
+				if d.overlayOnly(fp) {
+					// bazel doesn't know about files that haven't been saved yet,
+					// so the file is added to a package in the same directory.
+					if query, ok := d.overlayFileQuery(fp); ok {
+						if query != "" {
+							queries = append(queries, query)
+						}
+						d.fileQueries[fp] = true
+					}
+					continue
+				}
 				return nil, err
 			}
 			queries = append(queries, query)
 			d.fileQueries[fp] = true
-		} else if patt == "." {
-			queries = append(queries, goFilter(":all"))
-			d.wildcardQuery = true
-		} else if patt == "./..." {
-			queries = append(queries, goFilter("..."))
-			d.wildcardQuery = true
+		} else if isLabelPattern(patt) {
+			queries = append(queries, d.labelPattern(patt))
+		} else if isDirPattern(patt) {
+			targets, pkg, err := d.dirTargetPattern(patt)
+			if err != nil {
+				// Like go list, report the pattern as a package with an error.
+				patternErrors = append(patternErrors, &packages.Package{
+					ID:     patt,
+					Errors: []packages.Error{{Msg: err.Error(), Kind: packages.ListError}},
+				})
+				continue
+			}
+			queries = append(queries, d.goFilter(targets))
+			d.packageQueries[pkg] = true
+		} else if patt == "std" || patt == "cmd" {
+			for _, pkg := range d.stdPackages(patt) {
+				d.stdlibImports[pkg] = true
+			}
+		} else if patt == "all" {
+			// all is the workspace and everything it depends on.
+			queries = append(queries, d.goFilter("//..."))
+			d.allQuery = true
+			d.cfg.Mode |= packages.NeedDeps
 		} else if d.sdk.packages[patt] {
 			d.stdlibImports[patt] = true
+		} else if strings.Contains(patt, "...") {
+			re, err := regexp.Compile(importPathRegexp(patt))
+			if err != nil {
+				return nil, err
+			}
+			d.importPatterns = append(d.importPatterns, re)
+			for pkg := range d.sdk.packages {
+				if re.MatchString(pkg) {
+					d.stdlibImports[pkg] = true
+				}
+			}
+			queries = append(queries, d.importPathQuery(patt))
 		} else {
 			// TODO: do we need to check for a package ID instead of import path?
 			d.importQueries[patt] = true
-			queries = append(queries, fmt.Sprintf("attr(importpath, '%v', deps(%v))", patt, goFilter("//...")))
+			queries = append(queries, d.importPathQuery(patt))
 		}
 	}
 
@@ -152,10 +254,23 @@ func (d *bazelDriver) loadPackages(patterns ...string) (*driver.Response, error)
 	}
 
 	if len(queries) != 0 {
-		pkgs, roots, err := d.packagesFromQueries(queries)
+		load := d.packagesFromQueries
+		if d.backend == aspectBackend {
+			load = d.packagesFromAspect
+		}
+		pkgs, roots, err := load(queries)
 		if err != nil {
 			return nil, err
 		}
+		if d.cfg.Mode&packages.NeedExportsFile != 0 {
+			if err := d.addExportFiles(pkgs); err != nil {
+				return nil, xerrors.Errorf("addExportFiles: %w", err)
+			}
+		}
+		if d.wantModules() {
+			d.addModules(pkgs)
+			d.addMainModules(pkgs)
+		}
 		resp.Packages = append(resp.Packages, pkgs...)
 		resp.Roots = append(resp.Roots, roots...)
 	}
@@ -169,6 +284,13 @@ func (d *bazelDriver) loadPackages(patterns ...string) (*driver.Response, error)
 		resp.Roots = append(resp.Roots, ignoredPkg.ID)
 	}
 
+	for _, pkg := range patternErrors {
+		resp.Packages = append(resp.Packages, pkg)
+		resp.Roots = append(resp.Roots, pkg.ID)
+	}
+
+	d.addQueryErrors(&resp)
+
 	stdlib, err := d.sdk.loadPackages(&d.cfg, d.stdlibImports)
 	if err != nil {
 		return nil, err
@@ -185,8 +307,13 @@ func (d *bazelDriver) loadPackages(patterns ...string) (*driver.Response, error)
 }
 
 func (d *bazelDriver) convertFileQuery(path string) (string, error) {
-	log.Printf("bazel query %#v", path)
-	result, err := d.bazel.Query(path)
+	if index, err := d.fileIndex(); err != nil {
+		log.Printf("fileIndex: %v", err)
+	} else if labels := index.Files[filepath.ToSlash(path)]; len(labels) > 0 {
+		return strings.Join(labels, " + "), nil
+	}
+
+	result, err := d.query(path)
 	if err != nil {
 		return "", err
 	}
@@ -208,16 +335,52 @@ func (d *bazelDriver) convertFileQuery(path string) (string, error) {
 func (d *bazelDriver) packagesFromQueries(queries []string) (pkgs []*packages.Package, roots []string, err error) {
 	query := strings.Join(queries, "+")
 	if d.cfg.Mode&packages.NeedDeps != 0 {
-		query = goFilter(fmt.Sprintf("deps(%v)", query))
+		query = d.goFilter(fmt.Sprintf("deps(%v)", query))
 	}
 
-	log.Printf("bazel query %#v", query)
-	results, err := d.bazel.Query(query)
-	if err != nil {
-		return
+	if pkgs = d.cachedPackages(query); pkgs == nil {
+		log.Printf("bazel query %#v", query)
+		var results *blaze_query.QueryResult
+		var complete bool
+		results, complete, err = d.runQuery(query)
+		if err != nil {
+			return
+		}
+
+		generated, err := d.generatedFiles(pkgconv.Generators(results.GetTarget(), d.kinds))
+		if err != nil {
+			log.Printf("bazel aquery: %v, using default paths for generated files", err)
+			generated = nil
+		}
+
+		pkgs = pkgconv.Load(&d.cfg, results.GetTarget(), generated, d.kinds)
+		// An alias is converted into the package of its actual target.
+		d.resolveAliases(d.aliasTargets(results))
+		// The files of cgo packages were read to find the ones that import "C",
+		// so the cached packages depend on them too.
+		var read []string
+		for _, pkg := range pkgs {
+			if len(pkg.CompiledGoFiles) > 0 {
+				read = append(read, pkg.GoFiles...)
+			}
+		}
+		if compiled, err := d.compiledFiles(packageLabels(pkgs)); err != nil {
+			log.Printf("bazel aquery: %v, using the sources for CompiledGoFiles", err)
+		} else {
+			d.setCompiledGoFiles(pkgs, compiled)
+		}
+		d.rebaseBazelBin(pkgs)
+		if complete {
+			d.savePackages(query, results, pkgs, read)
+		}
 	}
 
-	pkgs = pkgconv.Load(results.GetTarget())
+	d.addOverlayFiles(pkgs)
+
+	ctxt := pkgconv.BuildContext(&d.cfg)
+	for _, pkg := range pkgs {
+		pkgconv.FilterFiles(ctxt, pkg)
+	}
 
 	log.Printf("file queries: %v", d.fileQueries)
 	for _, p := range pkgs {
@@ -226,18 +389,24 @@ func (d *bazelDriver) packagesFromQueries(queries []string) (pkgs []*packages.Pa
 		}
 	}
 
-	if d.cfg.Mode&packages.NeedCompiledGoFiles != 0 {
-		for _, pkg := range pkgs {
+	for _, pkg := range pkgs {
+		if d.cfg.Mode&packages.NeedCompiledGoFiles == 0 {
+			pkg.CompiledGoFiles = nil
+		} else if len(pkg.CompiledGoFiles) == 0 {
 			pkg.CompiledGoFiles = pkg.GoFiles
 		}
 	}
 	if d.cfg.Mode&(packages.NeedImports|packages.NeedName) != 0 {
 		for _, pkg := range pkgs {
-			name, imports, err := d.parsePackage(pkg)
-			if err != nil {
-				return nil, nil, xerrors.Errorf("parsePackage: %w", err)
-			}
+			name, imports := d.parsePackage(pkg)
 			pkg.Name = name
+			for _, i := range imports {
+				if i == `"C"` {
+					// Like go list, report the packages that cgo's generated code imports.
+					imports = append(imports, cgoImports...)
+					break
+				}
+			}
 			for _, i := range imports {
 				if i, err = strconv.Unquote(i); err == nil {
 					if d.sdk.packages[i] {
@@ -255,47 +424,98 @@ func (d *bazelDriver) packagesFromQueries(queries []string) (pkgs []*packages.Pa
 }
 
 func (d *bazelDriver) includeInRoots(pkg *packages.Package) bool {
-	if d.wildcardQuery {
-		return strings.HasPrefix(pkg.ID, "//")
+	if d.allQuery || d.labelQueries[pkg.ID] || d.matchPackageQuery(pkg.ID) {
+		return true
 	}
 	if pkg.PkgPath != "" && d.importQueries[pkg.PkgPath] {
 		return true
-	} else if len(d.fileQueries) > 0 && !strings.HasPrefix(pkg.ID, "@") {
-		for _, f := range pkg.GoFiles {
-			if d.fileQueries[f] {
-				return true
-			}
-			if rel, err := filepath.Rel(d.workspaceRoot, f); err == nil && d.fileQueries[rel] {
-				return true
-			}
+	}
+	for _, re := range d.importPatterns {
+		if pkg.PkgPath != "" && re.MatchString(pkg.PkgPath) {
+			return true
 		}
 	}
+	if len(d.fileQueries) > 0 && !strings.HasPrefix(pkg.ID, "@") {
+		return d.matchFileQuery(pkg.GoFiles) || d.matchFileQuery(pkg.IgnoredFiles)
+	}
 	return false
 }
 
-func (d *bazelDriver) parsePackage(pkg *packages.Package) (packageName string, imports []string, err error) {
+// matchFileQuery reports whether one of files is in a file= pattern.
+func (d *bazelDriver) matchFileQuery(files []string) bool {
+	for _, f := range files {
+		if d.fileQueries[f] {
+			return true
+		}
+		if rel, err := filepath.Rel(d.workspaceRoot, f); err == nil && d.fileQueries[rel] {
+			return true
+		}
+	}
+	return false
+}
+
+// packageLabels returns the labels of the targets pkgs were converted from.
+func packageLabels(pkgs []*packages.Package) []string {
+	var labels []string
+	seen := make(map[string]bool)
+	for _, pkg := range pkgs {
+		if label := targetLabel(pkg.ID); !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// targetLabel returns the label of the bazel target that the package with id
+// was converted from. The test packages for a go_test have IDs like
+// "example.com/foo [//foo:foo_test]", with the label in brackets.
+func targetLabel(id string) string {
+	if i := strings.Index(id, " ["); i >= 0 && strings.HasSuffix(id, "]") {
+		return id[i+2 : len(id)-1]
+	}
+	return id
+}
+
+// parsePackage returns the package name and imports of pkg.
+// Files that can't be read or parsed are reported in pkg.Errors, and the
+// rest of the files are still used.
+func (d *bazelDriver) parsePackage(pkg *packages.Package) (packageName string, imports []string) {
 	triedBuild := false
 	dedupe := make(map[string]bool)
 	fset := token.NewFileSet()
 
 	for _, filename := range pkg.GoFiles {
-		var f *os.File
-		f, err = os.Open(filename)
-		if os.IsNotExist(err) && !triedBuild {
-			triedBuild = true
-			log.Printf("bazel build %v\n", pkg.ID)
-			d.bazel.Build(pkg.ID)
-			f, err = os.Open(filename)
-		}
-		if err != nil {
-			return
+		parsed := d.cachedParse(filename)
+		if parsed == nil {
+			src, err := driver.ReadFile(&d.cfg, filename)
+			if os.IsNotExist(err) && !triedBuild {
+				triedBuild = true
+				log.Printf("bazel build %v\n", pkg.ID)
+				d.bazel.Build(pkg.ID)
+				src, err = driver.ReadFile(&d.cfg, filename)
+			}
+			if err != nil {
+				pkg.Errors = append(pkg.Errors, fileErrors(err)...)
+				continue
+			}
+			syntax, err := parser.ParseFile(fset, filename, src, parser.ImportsOnly)
+			if err != nil {
+				pkg.Errors = append(pkg.Errors, fileErrors(err)...)
+			}
+			if syntax != nil && syntax.Name != nil && syntax.Name.Name != "_" {
+				parsed = &parsedFile{Name: syntax.Name.Name}
+				for _, i := range syntax.Imports {
+					parsed.Imports = append(parsed.Imports, i.Path.Value)
+				}
+				if err == nil {
+					d.saveParse(filename, parsed)
+				}
+			}
 		}
-		defer f.Close()
-		var syntax *ast.File
-		if syntax, err = parser.ParseFile(fset, filename, f, parser.ImportsOnly); err == nil {
-			packageName = syntax.Name.Name
-			for _, i := range syntax.Imports {
-				pkg := i.Path.Value
+		if parsed != nil {
+			packageName = parsed.Name
+			for _, pkg := range parsed.Imports {
 				if !dedupe[pkg] {
 					dedupe[pkg] = true
 					imports = append(imports, pkg)
@@ -313,6 +533,282 @@ func (d *bazelDriver) parsePackage(pkg *packages.Package) (packageName string, i
 	return
 }
 
-func goFilter(expr string) string {
-	return fmt.Sprintf("kind(\"alias|proto_library|go_\", %s)", expr)
+// fileErrors converts an error from reading or parsing a file to package errors.
+// Syntax errors keep their positions.
+func fileErrors(err error) []packages.Error {
+	if list, ok := err.(scanner.ErrorList); ok {
+		var errs []packages.Error
+		for _, e := range list {
+			errs = append(errs, packages.Error{Pos: e.Pos.String(), Msg: e.Msg, Kind: packages.ParseError})
+		}
+		return errs
+	}
+	return []packages.Error{{Msg: err.Error(), Kind: packages.ListError}}
+}
+
+// rebaseBazelBin changes the default paths of generated files, which are
+// relative to the bazel-bin symlink, to the bazel-bin of the driver's output base.
+// It does nothing if the driver uses the same output base as the user.
+func (d *bazelDriver) rebaseBazelBin(pkgs []*packages.Package) {
+	bazelBin := d.bazelBin()
+	if bazelBin == "" {
+		return
+	}
+	rebase := func(files []string) {
+		for i, f := range files {
+			if rel := strings.TrimPrefix(f, "bazel-bin"+string(filepath.Separator)); rel != f {
+				files[i] = filepath.Join(bazelBin, rel)
+			}
+		}
+	}
+	for _, pkg := range pkgs {
+		rebase(pkg.GoFiles)
+		rebase(pkg.CompiledGoFiles)
+		rebase(pkg.OtherFiles)
+	}
+}
+
+// bazelBin returns the bazel-bin of the driver's output base for the bazel
+// flags in the request, or "" if the driver uses the same output base as the user.
+func (d *bazelDriver) bazelBin() string {
+	if !d.ws.OwnOutputBase {
+		return ""
+	}
+	bazelFlags, _ := splitBuildFlags(d.cfg.BuildFlags)
+	key := strings.Join(bazelFlags, " ")
+	if bazelBin, ok := d.ws.BazelBin[key]; ok {
+		return bazelBin
+	}
+	bazelBin, err := d.bazel.BazelBin()
+	if err != nil {
+		log.Printf("bazel info bazel-bin: %v", err)
+		return ""
+	}
+	d.ws.BazelBin[key] = bazelBin
+	d.ws.dirty = true
+	return bazelBin
+}
+
+// runQuery runs a bazel query. If bazel reports errors in BUILD files but
+// still returns a partial result, the errors are saved to be reported as
+// package errors, and complete is false so the result isn't cached.
+func (d *bazelDriver) runQuery(expr string) (result *blaze_query.QueryResult, complete bool, err error) {
+	result, err = d.bazel.Query(expr)
+	if qerr, ok := err.(*queryError); ok && result != nil {
+		log.Printf("bazel query %#v returned a partial result: %v", expr, qerr)
+		d.queryErrors = append(d.queryErrors, qerr.errs...)
+		return result, false, nil
+	}
+	return result, err == nil, err
+}
+
+// addQueryErrors adds the errors from bazel query to the packages defined in
+// the BUILD file that has the error. If there aren't any, the errors are
+// reported in a package whose ID is the bazel package, so they're still shown,
+// and it's a root if the bazel package matches a pattern. Errors without a
+// position are added to the roots.
+func (d *bazelDriver) addQueryErrors(resp *driver.Response) {
+	seen := make(map[packages.Error]bool)
+	byLabel := make(map[string][]packages.Error)
+	var labels []string
+	var unknown []packages.Error
+	for _, e := range d.queryErrors {
+		if seen[e] {
+			continue
+		}
+		seen[e] = true
+		if e.Pos == "" {
+			unknown = append(unknown, e)
+			continue
+		}
+		label := d.buildFileLabel(strings.SplitN(e.Pos, ":", 2)[0])
+		if byLabel[label] == nil {
+			labels = append(labels, label)
+		}
+		byLabel[label] = append(byLabel[label], e)
+	}
+	for _, label := range labels {
+		errs := byLabel[label]
+		found := false
+		for _, pkg := range resp.Packages {
+			if strings.HasPrefix(targetLabel(pkg.ID), label+":") {
+				pkg.Errors = append(pkg.Errors, errs...)
+				found = true
+			}
+		}
+		if !found {
+			resp.Packages = append(resp.Packages, &packages.Package{ID: label, Errors: errs})
+			if d.requestedPackage(label) {
+				resp.Roots = append(resp.Roots, label)
+			}
+		}
+	}
+	if len(unknown) == 0 {
+		return
+	}
+	roots := make(map[string]bool, len(resp.Roots))
+	for _, id := range resp.Roots {
+		roots[id] = true
+	}
+	for _, pkg := range resp.Packages {
+		if roots[pkg.ID] {
+			pkg.Errors = append(pkg.Errors, unknown...)
+		}
+	}
+}
+
+// requestedPackage reports whether the bazel package with label matches one
+// of the patterns of the request.
+func (d *bazelDriver) requestedPackage(label string) bool {
+	if d.allQuery || d.matchPackageQuery(label) {
+		return true
+	}
+	for l := range d.labelQueries {
+		if strings.HasPrefix(l, label+":") {
+			return true
+		}
+	}
+	for f := range d.fileQueries {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(d.workspaceRoot, f)
+		}
+		if d.buildFileLabel(f) == label {
+			return true
+		}
+	}
+	return false
+}
+
+// buildFileLabel returns the label of the bazel package for a BUILD file.
+// Files in external repositories get a label in that repository.
+func (d *bazelDriver) buildFileLabel(filename string) string {
+	dir := filepath.Dir(filename)
+	external := filepath.Join(filepath.Dir(filepath.Dir(d.execRoot)), "external")
+	if rel, err := filepath.Rel(external, dir); err == nil && !strings.HasPrefix(rel, "..") && rel != "." {
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		if len(parts) == 1 {
+			return "@" + parts[0] + "//"
+		}
+		return "@" + parts[0] + "//" + parts[1]
+	}
+	rel, err := filepath.Rel(d.workspaceRoot, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return dir
+	}
+	if rel == "." {
+		return "//"
+	}
+	return "//" + filepath.ToSlash(rel)
+}
+
+// overlayOnly reports whether filename only exists in the request overlay.
+func (d *bazelDriver) overlayOnly(filename string) bool {
+	if !driver.InOverlay(&d.cfg, filename) && !driver.InOverlay(&d.cfg, filepath.Join(d.workspaceRoot, filename)) {
+		return false
+	}
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(d.workspaceRoot, filename)
+	}
+	_, err := os.Stat(filename)
+	return os.IsNotExist(err)
+}
+
+// overlayFileQuery returns the query for the go targets in the directory of
+// filename, which only exists in the overlay. addOverlayFiles adds the file to
+// one of them. It returns false if the directory isn't a bazel package, and
+// an empty query if another file already added the query for the directory.
+func (d *bazelDriver) overlayFileQuery(filename string) (string, bool) {
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(d.workspaceRoot, filename)
+	}
+	dir := filepath.Dir(filename)
+	rel, err := filepath.Rel(d.workspaceRoot, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || !hasBuildFile(dir) {
+		log.Printf("skipping unsaved file %v: %v isn't a bazel package", filename, dir)
+		return "", false
+	}
+	pkg := "//"
+	if rel != "." {
+		pkg += filepath.ToSlash(rel)
+	}
+	for _, p := range d.overlayFiles {
+		if p == pkg {
+			d.overlayFiles[filename] = pkg
+			return "", true
+		}
+	}
+	d.overlayFiles[filename] = pkg
+	return d.goFilter(pkg + ":all"), true
+}
+
+// hasBuildFile reports whether dir has a BUILD file.
+func hasBuildFile(dir string) bool {
+	for _, name := range []string{"BUILD.bazel", "BUILD"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err == nil && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// addOverlayFiles adds each of d.overlayFiles to a package for a target in its
+// bazel package. _test.go files are added to the internal or external test
+// package of a go_test, depending on their package clause, and other files to
+// the first package that isn't a test.
+func (d *bazelDriver) addOverlayFiles(pkgs []*packages.Package) {
+	for filename, bazelPkg := range d.overlayFiles {
+		isTest := strings.HasSuffix(filename, "_test.go")
+		isXTest := isTest && strings.HasSuffix(d.packageClause(filename), "_test")
+		var found *packages.Package
+		for _, pkg := range pkgs {
+			label := targetLabel(pkg.ID)
+			if !strings.HasPrefix(label, bazelPkg+":") || strings.HasSuffix(pkg.PkgPath, ".test") {
+				// The package for the test main has a .test import path.
+				continue
+			}
+			if isTest != (label != pkg.ID) || isXTest != strings.HasSuffix(pkg.PkgPath, "_test") {
+				continue
+			}
+			found = pkg
+			break
+		}
+		if found == nil {
+			log.Printf("skipping unsaved file %v: no package for it in %v", filename, bazelPkg)
+			continue
+		}
+		// Copy the slices, which may share an array with other packages.
+		found.GoFiles = append(found.GoFiles[:len(found.GoFiles):len(found.GoFiles)], filename)
+		if len(found.CompiledGoFiles) > 0 {
+			found.CompiledGoFiles = append(found.CompiledGoFiles[:len(found.CompiledGoFiles):len(found.CompiledGoFiles)], filename)
+		}
+	}
+}
+
+// packageClause returns the package name in filename, or "" if it can't be parsed.
+func (d *bazelDriver) packageClause(filename string) string {
+	src, err := driver.ReadFile(&d.cfg, filename)
+	if err != nil {
+		return ""
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), filename, src, parser.PackageClauseOnly)
+	if err != nil {
+		return ""
+	}
+	return f.Name.Name
+}
+
+// goFilter returns a query for the go rules in expr, along with the rules of
+// the custom kinds.
+func goFilter(expr string, kinds ...string) string {
+	pattern := "alias|proto_library|go_"
+	for _, kind := range kinds {
+		pattern += "|" + regexp.QuoteMeta(kind)
+	}
+	return fmt.Sprintf("kind(\"%s\", %s)", pattern, expr)
+}
+
+// goFilter is like the goFilter function, and includes the custom rule kinds
+// from the config and the rule classes registered with pkgconv.Register.
+func (d *bazelDriver) goFilter(expr string) string {
+	return goFilter(expr, append(d.kinds.Classes(), pkgconv.Registered()...)...)
 }
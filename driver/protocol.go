@@ -27,8 +27,8 @@ type Request struct {
 	Mode       packages.LoadMode `json:"mode"`
 	Env        []string          `json:"env"` // FIXME handle
 	BuildFlags []string          `json:"build_flags"`
-	Tests      bool              `json:"tests"`   // FIXME handle
-	Overlay    map[string][]byte `json:"overlay"` // FIXME handle
+	Tests      bool              `json:"tests"` // FIXME handle
+	Overlay    map[string][]byte `json:"overlay"`
 }
 
 // Response is a JSON object sent by this program to
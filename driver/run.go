@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -30,6 +31,8 @@ type Driver func(cfg Request, patterns ...string) (*Response, error)
 // Run implements the gopackagesdriver protocol.
 // It reads a DriverRequest from stdin, passes the request to driver, and
 // writes the response to stdout.
+// If a daemon started by Serve is running for the workspace, the request is
+// forwarded to it instead of calling driver.
 // If driver returns an error, Run will terminate the process.
 func Run(driver Driver) {
 	cleanup := func() error { return nil }
@@ -75,9 +78,13 @@ func run(driver Driver, args []string) error {
 		return fmt.Errorf("could not unmarshal driver request: %v", err)
 	}
 
-	resp, err := driver(req, args...)
+	resp, err := callDaemon(req, args)
 	if err != nil {
 		return err
+	} else if resp != nil {
+		log.Printf("handled by daemon")
+	} else if resp, err = driver(req, args...); err != nil {
+		return err
 	}
 
 	if os.Getenv("GOPACKAGESDRIVER_DUMP_RESPONSE") != "" {
@@ -110,3 +117,36 @@ func GetEnv(cfg *Request, name, def string) string {
 	}
 	return result
 }
+
+// ReadFile returns the contents of filename, preferring the unsaved contents
+// from cfg.Overlay over the file on disk.
+// Overlay paths may be absolute or relative to the working directory, so
+// relative filenames are also looked up by their absolute path.
+func ReadFile(cfg *Request, filename string) ([]byte, error) {
+	if contents, ok := overlayContents(cfg, filename); ok {
+		return contents, nil
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// InOverlay reports whether cfg.Overlay has contents for filename.
+func InOverlay(cfg *Request, filename string) bool {
+	_, ok := overlayContents(cfg, filename)
+	return ok
+}
+
+func overlayContents(cfg *Request, filename string) ([]byte, bool) {
+	if len(cfg.Overlay) == 0 {
+		return nil, false
+	}
+	if contents, ok := cfg.Overlay[filename]; ok {
+		return contents, true
+	}
+	if !filepath.IsAbs(filename) {
+		if abs, err := filepath.Abs(filename); err == nil {
+			contents, ok := cfg.Overlay[abs]
+			return contents, ok
+		}
+	}
+	return nil, false
+}
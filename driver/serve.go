@@ -0,0 +1,359 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serveRequest is sent by the client to the daemon for each invocation of the driver.
+type serveRequest struct {
+	Dir string
+	// Env is the part of the client's environment that the driver reads,
+	// which the daemon uses while it handles the request.
+	Env []string
+	// Binary is the identity of the client, which has to match the daemon's.
+	Binary   string
+	Request  Request
+	Patterns []string
+}
+
+// dialTimeout is how long the client waits to connect to the daemon, and
+// requestTimeout is how long it waits for the daemon to handle a request.
+const (
+	dialTimeout    = time.Second
+	requestTimeout = 10 * time.Minute
+)
+
+// serveResponse is the daemon's reply to a serveRequest.
+type serveResponse struct {
+	Response *Response
+	Error    string
+	// Refused is set if the daemon is a different binary than the client,
+	// so the client loads the packages itself.
+	Refused bool
+}
+
+// extensions are the names added with RegisterExtension.
+var extensions []string
+
+// RegisterExtension records that the binary has an extension called name,
+// like a rule class registered with pkgconv.Register. The extensions are part
+// of the identity of the binary, so requests are only forwarded to a daemon
+// that has the same ones.
+// RegisterExtension isn't safe for concurrent use, so call it before Run or Serve.
+func RegisterExtension(name string) {
+	extensions = append(extensions, name)
+}
+
+// binaryIdentity returns the main package and version of the binary, and the
+// extensions it has. Binaries built from a checkout all have the version
+// (devel), so the hash of the executable is used for those instead, and a
+// rebuilt wrapper doesn't use the daemon of the previous build.
+func binaryIdentity() string {
+	var main, version string
+	if info, ok := debug.ReadBuildInfo(); ok {
+		main, version = info.Path, info.Main.Version
+	}
+	if version == "" || version == "(devel)" {
+		version = executableHash()
+	}
+	names := append([]string(nil), extensions...)
+	sort.Strings(names)
+	return main + "@" + version + " " + strings.Join(names, ",")
+}
+
+// executableHash returns the hash of the running binary, or "" if it can't be read.
+func executableHash() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)[:8])
+}
+
+// workspaceFiles are the files that mark the root of a bazel workspace.
+var workspaceFiles = []string{"WORKSPACE", "WORKSPACE.bazel", "MODULE.bazel"}
+
+// SocketPath returns the unix socket used by the daemon for the workspace containing dir.
+// Wrapper binaries with different extensions use different sockets.
+// The socket is in a directory that only the user can access.
+// GOPACKAGESDRIVER_SOCKET overrides the default location.
+func SocketPath(dir string) string {
+	if socket := os.Getenv("GOPACKAGESDRIVER_SOCKET"); socket != "" {
+		return socket
+	}
+	return socketPath(dir, binaryIdentity())
+}
+
+// socketPath returns the default socket for the workspace containing dir and
+// the binary with identity.
+func socketPath(dir, identity string) string {
+	root := WorkspaceRoot(dir)
+	if root == "" {
+		root = dir
+	}
+	sum := sha256.Sum256([]byte(root + "\x00" + identity))
+	return filepath.Join(socketDir(), fmt.Sprintf("%x.sock", sum[:8]))
+}
+
+// socketDir returns the per-user directory for the daemon sockets.
+func socketDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "bazelpackagesdriver")
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "bazelpackagesdriver", "daemon")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("bazelpackagesdriver-%d", os.Getuid()))
+}
+
+// checkSocketDir checks that other users can't replace a socket in dir: it
+// has to belong to the user, or be sticky like /tmp.
+func checkSocketDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() || (!ownedByUser(fi) && fi.Mode()&os.ModeSticky == 0) {
+		return fmt.Errorf("%v isn't a directory owned by the user", dir)
+	}
+	return nil
+}
+
+// checkSocket checks that socket is a unix socket that only the user can use,
+// so requests, which include the overlay and part of the environment, aren't
+// sent to another user's process.
+func checkSocket(socket string) error {
+	if err := checkSocketDir(filepath.Dir(socket)); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(socket)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 || !ownedByUser(fi) || fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%v isn't a socket that only the user can access", socket)
+	}
+	return nil
+}
+
+// forwardedEnv are the environment variables the driver reads, which the
+// client sends to the daemon. Variables that start with GOPACKAGESDRIVER_
+// are forwarded too.
+var forwardedEnv = map[string]bool{
+	"GOOS":        true,
+	"GOARCH":      true,
+	"GOARM":       true,
+	"CGO_ENABLED": true,
+	"GOFLAGS":     true,
+}
+
+// isForwarded reports whether the variable kv, in key=value form, is sent to the daemon.
+func isForwarded(kv string) bool {
+	name := strings.SplitN(kv, "=", 2)[0]
+	return forwardedEnv[name] || strings.HasPrefix(name, "GOPACKAGESDRIVER_")
+}
+
+// filterEnv returns the variables in env that are, or with forwarded false
+// aren't, sent to the daemon.
+func filterEnv(env []string, forwarded bool) []string {
+	var result []string
+	for _, kv := range env {
+		if isForwarded(kv) == forwarded {
+			result = append(result, kv)
+		}
+	}
+	return result
+}
+
+// WorkspaceRoot returns the closest parent of dir containing one of workspaceFiles,
+// or "" if there isn't one.
+func WorkspaceRoot(dir string) string {
+	for d := dir; ; d = filepath.Dir(d) {
+		for _, name := range workspaceFiles {
+			if _, err := os.Stat(filepath.Join(d, name)); err == nil {
+				return d
+			}
+		}
+		if filepath.Dir(d) == d {
+			return ""
+		}
+	}
+}
+
+// Serve runs driver as a daemon listening on socket.
+// Requests are handled one at a time, in the working directory and with the
+// go and GOPACKAGESDRIVER_ variables from the environment of the client, so
+// the driver sees the same settings it would when run directly.
+// Only the user can connect to the socket.
+func Serve(driver Driver, socket string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return err
+	}
+	if err := checkSocketDir(filepath.Dir(socket)); err != nil {
+		return err
+	}
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return fmt.Errorf("%v is already in use", socket)
+	}
+	if fi, err := os.Lstat(socket); err == nil {
+		// Only remove a stale socket of the user's.
+		if fi.Mode()&os.ModeSocket == 0 || !ownedByUser(fi) {
+			return fmt.Errorf("%v already exists", socket)
+		}
+		os.Remove(socket)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+	log.Printf("listening on %v", socket)
+
+	var mu sync.Mutex
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			var req serveRequest
+			if err := json.NewDecoder(conn).Decode(&req); err != nil {
+				log.Printf("could not decode request: %v", err)
+				return
+			}
+			mu.Lock()
+			resp := serveOne(driver, &req)
+			mu.Unlock()
+			if err := json.NewEncoder(conn).Encode(resp); err != nil {
+				log.Printf("could not send response: %v", err)
+			}
+		}()
+	}
+}
+
+func serveOne(driver Driver, req *serveRequest) (resp serveResponse) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("panic: %v", err)
+			resp = serveResponse{Error: fmt.Sprint(err)}
+		}
+	}()
+	log.Printf("%v: %v", req.Dir, req.Patterns)
+	if id := binaryIdentity(); req.Binary != id {
+		log.Printf("refusing request from %#v, the daemon is %#v", req.Binary, id)
+		return serveResponse{Refused: true}
+	}
+	if err := os.Chdir(req.Dir); err != nil {
+		return serveResponse{Error: err.Error()}
+	}
+	defer setEnv(req.Env)()
+	// The client only sends the variables the driver reads, so the request
+	// gets the rest, like PATH and HOME for the go command, from the daemon.
+	req.Request.Env = append(filterEnv(os.Environ(), false), filterEnv(req.Request.Env, true)...)
+	r, err := driver(req.Request, req.Patterns...)
+	if err != nil {
+		return serveResponse{Error: err.Error()}
+	}
+	log.Printf(" -> %d packages, %d roots", len(r.Packages), len(r.Roots))
+	return serveResponse{Response: r}
+}
+
+// callDaemon forwards a request to the daemon for the current directory.
+// It returns a nil Response if there is no daemon running, or if the daemon
+// is a different binary.
+func callDaemon(req Request, patterns []string) (*Response, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	socket := SocketPath(wd)
+	if err := checkSocket(socket); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("not using the daemon: %v", err)
+		}
+		return nil, nil
+	}
+	conn, err := net.DialTimeout("unix", socket, dialTimeout)
+	if err != nil {
+		return nil, nil
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return nil, err
+	}
+	req.Env = filterEnv(req.Env, true)
+	if err := json.NewEncoder(conn).Encode(serveRequest{Dir: wd, Env: filterEnv(os.Environ(), true), Binary: binaryIdentity(), Request: req, Patterns: patterns}); err != nil {
+		return nil, err
+	}
+	var resp serveResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("could not read daemon response: %v", err)
+	}
+	if resp.Refused {
+		log.Printf("the daemon is a different binary")
+		return nil, nil
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("daemon: %v", resp.Error)
+	}
+	return resp.Response, nil
+}
+
+// setEnv replaces the forwarded variables in the environment of the process
+// with the ones in env, and returns a function that restores the previous
+// environment.
+func setEnv(env []string) func() {
+	old := os.Environ()
+	replaceEnv(append(filterEnv(old, false), filterEnv(env, true)...))
+	return func() { replaceEnv(old) }
+}
+
+func replaceEnv(env []string) {
+	os.Clearenv()
+	for _, kv := range env {
+		// On windows there are variables like =C:, which can't be set.
+		if i := strings.Index(kv, "="); i > 0 {
+			os.Setenv(kv[:i], kv[i+1:])
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestServeOneEnv(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOPACKAGESDRIVER_TEST", "daemon")
+	defer os.Unsetenv("GOPACKAGESDRIVER_TEST")
+
+	var got string
+	var cfgEnv []string
+	driver := func(cfg Request, patterns ...string) (*Response, error) {
+		got = os.Getenv("GOPACKAGESDRIVER_TEST")
+		cfgEnv = cfg.Env
+		return &Response{}, nil
+	}
+	resp := serveOne(driver, &serveRequest{
+		Dir:     wd,
+		Env:     []string{"GOPACKAGESDRIVER_TEST=client"},
+		Binary:  binaryIdentity(),
+		Request: Request{Env: []string{"GOOS=plan9"}},
+	})
+	if resp.Error != "" {
+		t.Fatal(resp.Error)
+	}
+	if got != "client" {
+		t.Errorf("driver ran with GOPACKAGESDRIVER_TEST=%v, want the client's value", got)
+	}
+	if env := os.Getenv("GOPACKAGESDRIVER_TEST"); env != "daemon" {
+		t.Errorf("after the request GOPACKAGESDRIVER_TEST=%v, want the daemon's value", env)
+	}
+	cfg := Request{Env: cfgEnv}
+	if goos := GetEnv(&cfg, "GOOS", ""); goos != "plan9" {
+		t.Errorf("request GOOS = %v, want the client's value", goos)
+	}
+	if path := GetEnv(&cfg, "PATH", ""); path != os.Getenv("PATH") {
+		t.Errorf("request PATH = %v, want the daemon's value", path)
+	}
+}
+
+func TestFilterEnv(t *testing.T) {
+	env := []string{"GOOS=linux", "GOPACKAGESDRIVER_BACKEND=aspect", "GITHUB_TOKEN=secret", "HOME=/home/x", "CGO_ENABLED=0"}
+	if got, want := filterEnv(env, true), []string{"GOOS=linux", "GOPACKAGESDRIVER_BACKEND=aspect", "CGO_ENABLED=0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filterEnv(true) = %v, want %v", got, want)
+	}
+	if got, want := filterEnv(env, false), []string{"GITHUB_TOKEN=secret", "HOME=/home/x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filterEnv(false) = %v, want %v", got, want)
+	}
+}
+
+func TestDaemonRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bazelpackagesdriver-serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "d", "test.sock")
+	os.Setenv("GOPACKAGESDRIVER_SOCKET", socket)
+	defer os.Unsetenv("GOPACKAGESDRIVER_SOCKET")
+
+	driver := func(cfg Request, patterns ...string) (*Response, error) {
+		return &Response{Roots: patterns, Packages: []*packages.Package{{ID: GetEnv(&cfg, "GOOS", "")}}}, nil
+	}
+	go Serve(driver, socket)
+	deadline := time.Now().Add(10 * time.Second)
+	for checkSocket(socket) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("daemon didn't start: %v", checkSocket(socket))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v; want 0600", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(filepath.Dir(socket)); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("socket directory mode = %v, %v; want 0700", fi.Mode(), err)
+	}
+
+	resp, err := callDaemon(Request{Env: []string{"GOOS=plan9"}}, []string{"./..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil {
+		t.Fatal("the daemon didn't handle the request")
+	}
+	if !reflect.DeepEqual(resp.Roots, []string{"./..."}) || len(resp.Packages) != 1 || resp.Packages[0].ID != "plan9" {
+		t.Errorf("callDaemon() = %+v, want the daemon's response", resp)
+	}
+
+	// A socket that other users can connect to isn't used.
+	if err := os.Chmod(socket, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := callDaemon(Request{}, nil); resp != nil || err != nil {
+		t.Errorf("callDaemon() with a public socket = %v, %v; want nil", resp, err)
+	}
+}
+
+func TestServeOneOtherBinary(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := binaryIdentity()
+	socket := SocketPath(wd)
+	RegisterExtension("test:acme_go_library")
+	defer func() { extensions = extensions[:len(extensions)-1] }()
+	if SocketPath(wd) == socket {
+		t.Errorf("SocketPath() didn't change with the extensions")
+	}
+
+	called := false
+	driver := func(cfg Request, patterns ...string) (*Response, error) {
+		called = true
+		return &Response{}, nil
+	}
+	resp := serveOne(driver, &serveRequest{Dir: wd, Binary: client})
+	if !resp.Refused || called {
+		t.Errorf("daemon with another extension handled the request: %+v", resp)
+	}
+}
+
+func TestSocketPathIdentity(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := binaryIdentity()
+	// The test binary is a devel build, so it's identified by its hash.
+	if hash := executableHash(); hash == "" || !strings.Contains(id, "@"+hash+" ") {
+		t.Errorf("binaryIdentity() = %q, want the executable hash %q", id, hash)
+	}
+	rebuilt := strings.Replace(id, "@"+executableHash(), "@0123456789abcdef", 1)
+	if socketPath(wd, id) == socketPath(wd, rebuilt) {
+		t.Errorf("a rebuilt binary uses the same socket %v", socketPath(wd, id))
+	}
+	if socketPath(wd, id) != socketPath(wd, binaryIdentity()) {
+		t.Errorf("socketPath() isn't stable for the same binary")
+	}
+}
@@ -0,0 +1,1558 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"github.com/derivita/bazelpackagesdriver/pkgconv"
+	"golang.org/x/tools/go/packages"
+)
+
+// testWorkspace creates a workspace with two packages, where //foo imports //bar,
+// and returns its root directory.
+func testWorkspace(t *testing.T) string {
+	root, err := ioutil.TempDir("", "bazelpackagesdriver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	files := map[string]string{
+		"WORKSPACE":       "",
+		"foo/BUILD.bazel": "",
+		"foo/foo.go":      "package foo\n\nimport _ \"example.com/bar\"\n",
+		"foo/new.go":      "package foo\n",
+		"bar/BUILD.bazel": "",
+		"bar/bar.go":      "package bar\n",
+		"external/README": "",
+	}
+	for name, content := range files {
+		filename := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The sdk is in external, like it is in the output base.
+	if err := os.Symlink(runtime.GOROOT(), filepath.Join(root, "external", "go_sdk")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// dumpPackages formats pkgs for test failures.
+func dumpPackages(pkgs []*packages.Package) string {
+	data, err := json.MarshalIndent(pkgs, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestDriver(root string, bzl *fakeBazel, mode packages.LoadMode) *bazelDriver {
+	sdk := &gosdk{
+		goroot:   filepath.Join(root, "external", "go_sdk"),
+		packages: map[string]bool{"fmt": true},
+	}
+	return &bazelDriver{
+		cfg:   driver.Request{Mode: mode, Env: os.Environ()},
+		bazel: bzl,
+		ws: &workspace{
+			Root:     root,
+			Queries:  make(map[string]*cachedQuery),
+			Packages: make(map[string]*cachedPackages),
+			Files:    make(map[string]*parsedFile),
+			sdk:      sdk,
+		},
+		sdk:            sdk,
+		workspaceRoot:  root,
+		execRoot:       filepath.Join(root, "execroot"),
+		backend:        queryBackend,
+		stdlibImports:  make(map[string]bool),
+		fileQueries:    make(map[string]bool),
+		importQueries:  make(map[string]bool),
+		packageQueries: make(map[string]bool),
+		labelQueries:   make(map[string]bool),
+		overlayFiles:   make(map[string]string),
+		wd:             root,
+	}
+}
+
+func TestLoadPackages(t *testing.T) {
+	root := testWorkspace(t)
+	foo := rule("go_library", "//foo:foo", filepath.Join(root, "foo/BUILD.bazel:1:11"),
+		stringAttr("importpath", "example.com/foo"),
+		listAttr("srcs", "//foo:foo.go"),
+		listAttr("deps", "//bar:bar"),
+	)
+	bar := rule("go_library", "//bar:bar", filepath.Join(root, "bar/BUILD.bazel:1:11"),
+		stringAttr("importpath", "example.com/bar"),
+		listAttr("srcs", "//bar:bar.go"),
+	)
+	newFile := sourceFile("//foo:new.go", filepath.Join(root, "foo/new.go:1:1"))
+	fooNew := rule("go_library", "//foo:new", filepath.Join(root, "foo/BUILD.bazel:7:11"),
+		stringAttr("importpath", "example.com/foo/new"),
+		listAttr("srcs", "//foo:new.go"),
+	)
+	fooAlias := rule("alias", "//foo:alias", filepath.Join(root, "foo/BUILD.bazel:13:6"),
+		stringAttr("actual", "//foo:foo"),
+	)
+	importFoo := fmt.Sprintf(`attr(importpath, '^example\.com/foo$', deps(%v))`, goFilter("//..."))
+	importFooTree := fmt.Sprintf(`attr(importpath, '^example\.com/foo(/.*)?$', deps(%v))`, goFilter("//..."))
+
+	// link is a symlink to the workspace, like an editor might open it from.
+	link := root + "-link"
+	if err := os.Symlink(root, link); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(link) })
+
+	const mode = packages.NeedName | packages.NeedFiles | packages.NeedImports
+	tests := []struct {
+		name     string
+		patterns []string
+		// wd is the directory the driver runs in, if it isn't the workspace root.
+		wd           string
+		mode         packages.LoadMode
+		queries      map[string][]*blaze_query.Target
+		wantRoots    []string
+		wantPackages map[string]string
+	}{
+		{
+			name:         "recursive wildcard",
+			patterns:     []string{"./..."},
+			queries:      map[string][]*blaze_query.Target{goFilter("//..."): {foo, bar}},
+			wantRoots:    []string{"//bar:bar", "//foo:foo"},
+			wantPackages: map[string]string{"//bar:bar": "bar", "//foo:foo": "foo"},
+		},
+		{
+			name:         "current directory",
+			queries:      map[string][]*blaze_query.Target{goFilter("//:all"): {}},
+			wantPackages: map[string]string{},
+		},
+		{
+			name:         "current directory with a package",
+			wd:           filepath.Join(root, "foo"),
+			queries:      map[string][]*blaze_query.Target{goFilter("//foo:all"): {foo}},
+			wantRoots:    []string{"//foo:foo"},
+			wantPackages: map[string]string{"//foo:foo": "foo"},
+		},
+		{
+			name:         "current directory through a symlink",
+			patterns:     []string{"."},
+			wd:           filepath.Join(link, "foo"),
+			queries:      map[string][]*blaze_query.Target{goFilter("//foo:all"): {foo}},
+			wantRoots:    []string{"//foo:foo"},
+			wantPackages: map[string]string{"//foo:foo": "foo"},
+		},
+		{
+			name:         "relative directory",
+			patterns:     []string{"./foo"},
+			queries:      map[string][]*blaze_query.Target{goFilter("//foo:all"): {foo}},
+			wantRoots:    []string{"//foo:foo"},
+			wantPackages: map[string]string{"//foo:foo": "foo"},
+		},
+		{
+			name:         "relative directory with deps",
+			patterns:     []string{"./foo"},
+			mode:         packages.NeedDeps,
+			queries:      map[string][]*blaze_query.Target{goFilter(fmt.Sprintf("deps(%v)", goFilter("//foo:all"))): {foo, bar}},
+			wantRoots:    []string{"//foo:foo"},
+			wantPackages: map[string]string{"//bar:bar": "bar", "//foo:foo": "foo"},
+		},
+		{
+			name:         "absolute subtree",
+			patterns:     []string{filepath.Join(root, "bar") + "/..."},
+			queries:      map[string][]*blaze_query.Target{goFilter("//bar/..."): {bar}},
+			wantRoots:    []string{"//bar:bar"},
+			wantPackages: map[string]string{"//bar:bar": "bar"},
+		},
+		{
+			name:         "outside the workspace",
+			patterns:     []string{"../..."},
+			wantRoots:    []string{"../..."},
+			wantPackages: map[string]string{"../...": ""},
+		},
+		{
+			name:         "all",
+			patterns:     []string{"all"},
+			queries:      map[string][]*blaze_query.Target{goFilter(fmt.Sprintf("deps(%v)", goFilter("//..."))): {foo, bar}},
+			wantRoots:    []string{"//bar:bar", "//foo:foo"},
+			wantPackages: map[string]string{"//bar:bar": "bar", "//foo:foo": "foo"},
+		},
+		{
+			name:         "label",
+			patterns:     []string{"//foo:foo"},
+			mode:         packages.NeedDeps,
+			queries:      map[string][]*blaze_query.Target{goFilter(fmt.Sprintf("deps(%v)", goFilter("//foo:foo"))): {foo, bar}},
+			wantRoots:    []string{"//foo:foo"},
+			wantPackages: map[string]string{"//bar:bar": "bar", "//foo:foo": "foo"},
+		},
+		{
+			name:         "alias",
+			patterns:     []string{"//foo:alias"},
+			mode:         packages.NeedDeps,
+			queries:      map[string][]*blaze_query.Target{goFilter(fmt.Sprintf("deps(%v)", goFilter("//foo:alias"))): {fooAlias, foo, bar}},
+			wantRoots:    []string{"//foo:foo"},
+			wantPackages: map[string]string{"//bar:bar": "bar", "//foo:foo": "foo"},
+		},
+		{
+			name:         "label wildcard",
+			patterns:     []string{"//foo:all", "@//bar/..."},
+			queries:      map[string][]*blaze_query.Target{goFilter("//foo:all") + "+" + goFilter("@//bar/..."): {foo, fooNew, bar}},
+			wantRoots:    []string{"//bar:bar", "//foo:foo", "//foo:new"},
+			wantPackages: map[string]string{"//bar:bar": "bar", "//foo:foo": "foo", "//foo:new": "foo"},
+		},
+		{
+			name:         "std",
+			patterns:     []string{"std"},
+			wantRoots:    []string{"fmt"},
+			wantPackages: map[string]string{"fmt": "fmt"},
+		},
+		{
+			name:         "import path",
+			patterns:     []string{"example.com/foo"},
+			queries:      map[string][]*blaze_query.Target{importFoo: {foo}},
+			wantRoots:    []string{"//foo:foo"},
+			wantPackages: map[string]string{"//foo:foo": "foo"},
+		},
+		{
+			name:         "import path wildcard",
+			patterns:     []string{"example.com/foo/..."},
+			queries:      map[string][]*blaze_query.Target{importFooTree: {foo, fooNew}},
+			wantRoots:    []string{"//foo:foo", "//foo:new"},
+			wantPackages: map[string]string{"//foo:foo": "foo", "//foo:new": "foo"},
+		},
+		{
+			name:         "import path with deps",
+			patterns:     []string{"example.com/foo"},
+			mode:         packages.NeedDeps,
+			queries:      map[string][]*blaze_query.Target{goFilter(fmt.Sprintf("deps(%v)", importFoo)): {foo, bar}},
+			wantRoots:    []string{"//foo:foo"},
+			wantPackages: map[string]string{"//bar:bar": "bar", "//foo:foo": "foo"},
+		},
+		{
+			name:     "file from index",
+			patterns: []string{"file=bar/bar.go"},
+			queries: map[string][]*blaze_query.Target{
+				goFilter("//..."): {foo, bar},
+				"//bar:bar":       {bar},
+			},
+			wantRoots:    []string{"//bar:bar"},
+			wantPackages: map[string]string{"//bar:bar": "bar"},
+		},
+		{
+			name:     "absolute file",
+			patterns: []string{"file=" + filepath.Join(root, "foo/foo.go")},
+			queries: map[string][]*blaze_query.Target{
+				goFilter("//..."): {foo, bar},
+				"//foo:foo":       {foo},
+			},
+			wantRoots:    []string{"//foo:foo"},
+			wantPackages: map[string]string{"//foo:foo": "foo"},
+		},
+		{
+			name:     "file missing from index",
+			patterns: []string{"file=foo/new.go"},
+			queries: map[string][]*blaze_query.Target{
+				goFilter("//..."):                       {foo, bar},
+				"foo/new.go":                            {newFile},
+				"attr(srcs, '//foo:new.go', '//foo:*')": {fooNew},
+			},
+			wantRoots:    []string{"//foo:new"},
+			wantPackages: map[string]string{"//foo:new": "foo"},
+		},
+		{
+			name:         "file in go_sdk",
+			patterns:     []string{"file=bazel-module/external/go_sdk/src/fmt/print.go"},
+			wantRoots:    []string{"bazel-module/external/go_sdk"},
+			wantPackages: map[string]string{"bazel-module/external/go_sdk": "bazel-module/external/go_sdk"},
+		},
+		{
+			name:         "stdlib",
+			patterns:     []string{"fmt"},
+			wantRoots:    []string{"fmt"},
+			wantPackages: map[string]string{"fmt": "fmt"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bzl := &fakeBazel{queries: tc.queries}
+			d := newTestDriver(root, bzl, mode|tc.mode)
+			if tc.wd != "" {
+				d.wd = tc.wd
+			}
+			resp, err := d.loadPackages(tc.patterns...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(resp.Roots)
+			if !reflect.DeepEqual(resp.Roots, tc.wantRoots) {
+				t.Errorf("Roots = %v, want %v", resp.Roots, tc.wantRoots)
+			}
+			names := make(map[string]string)
+			for _, pkg := range resp.Packages {
+				names[pkg.ID] = pkg.Name
+			}
+			if !reflect.DeepEqual(names, tc.wantPackages) {
+				t.Errorf("Packages = %v, want %v", names, tc.wantPackages)
+			}
+		})
+	}
+}
+
+func TestLoadPackagesCachedAlias(t *testing.T) {
+	root := testWorkspace(t)
+	query := goFilter("//foo:alias")
+	bzl := &fakeBazel{queries: map[string][]*blaze_query.Target{query: {
+		rule("alias", "//foo:alias", filepath.Join(root, "foo/BUILD.bazel:7:6"),
+			stringAttr("actual", "//foo:foo"),
+		),
+		rule("go_library", "//foo:foo", filepath.Join(root, "foo/BUILD.bazel:1:11"),
+			stringAttr("importpath", "example.com/foo"),
+			listAttr("srcs", "//foo:foo.go"),
+		),
+	}}}
+	d := newTestDriver(root, bzl, packages.NeedName)
+	if _, err := d.loadPackages("//foo:alias"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new request with the same query gets the packages from the cache.
+	cached := newTestDriver(root, bzl, packages.NeedName)
+	cached.ws = d.ws
+	resp, err := cached.loadPackages("//foo:alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bzl.ran) != 1 {
+		t.Errorf("ran queries %v, want the second request to use the cache", bzl.ran)
+	}
+	if want := []string{"//foo:foo"}; !reflect.DeepEqual(resp.Roots, want) {
+		t.Errorf("Roots = %v, want %v", resp.Roots, want)
+	}
+}
+
+func TestLoadPackagesOverlayFile(t *testing.T) {
+	root := testWorkspace(t)
+	if err := ioutil.WriteFile(filepath.Join(root, "foo/x_test.go"), []byte("package foo_test\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	foo := rule("go_library", "//foo:foo", filepath.Join(root, "foo/BUILD.bazel:1:11"),
+		stringAttr("importpath", "example.com/foo"),
+		listAttr("srcs", "//foo:foo.go"),
+	)
+	fooTest := rule("go_test", "//foo:foo_test", filepath.Join(root, "foo/BUILD.bazel:7:8"),
+		listAttr("srcs", "//foo:x_test.go"),
+		listAttr("embed", "//foo:foo"),
+	)
+	bzl := &fakeBazel{queries: map[string][]*blaze_query.Target{
+		goFilter("//..."):     {foo, fooTest},
+		goFilter("//foo:all"): {foo, fooTest},
+	}}
+	d := newTestDriver(root, bzl, packages.NeedName|packages.NeedFiles|packages.NeedImports)
+	unsaved := filepath.Join(root, "foo/unsaved.go")
+	unsavedTest := filepath.Join(root, "foo/unsaved_test.go")
+	d.cfg.Overlay = map[string][]byte{
+		unsaved:     []byte("package foo\n\nimport \"fmt\"\n"),
+		unsavedTest: []byte("package foo_test\n"),
+	}
+	resp, err := d.loadPackages("file=foo/unsaved.go", "file="+unsavedTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(resp.Roots)
+	wantRoots := []string{"//foo:foo", "example.com/foo_test [//foo:foo_test]"}
+	if !reflect.DeepEqual(resp.Roots, wantRoots) {
+		t.Errorf("Roots = %v, want %v", resp.Roots, wantRoots)
+	}
+	files := make(map[string][]string)
+	for _, pkg := range resp.Packages {
+		files[pkg.ID] = pkg.GoFiles
+		if pkg.ID == "//foo:foo" && pkg.Imports["fmt"] == nil {
+			t.Errorf("//foo:foo imports %v, want fmt from the unsaved file", pkg.Imports)
+		}
+	}
+	if got, want := files["//foo:foo"], []string{filepath.Join(root, "foo/foo.go"), unsaved}; !reflect.DeepEqual(got, want) {
+		t.Errorf("//foo:foo GoFiles = %v, want %v", got, want)
+	}
+	if got, want := files["example.com/foo_test [//foo:foo_test]"], []string{filepath.Join(root, "foo/x_test.go"), unsavedTest}; !reflect.DeepEqual(got, want) {
+		t.Errorf("external test GoFiles = %v, want %v", got, want)
+	}
+}
+
+func TestSetCompiledGoFiles(t *testing.T) {
+	// The compile actions for a cgo library and a go_test, as written by
+	// bazel aquery --output=jsonproto, and for a cgo library compiled by a
+	// version of rules_go that runs cgo in the compile action.
+	aquery := `{
+		"artifacts": [
+			{"id": 1, "execPath": "foo/foo.go"},
+			{"id": 2, "execPath": "bazel-out/k8-fastbuild/bin/foo/cgo.cgo1.go"},
+			{"id": 3, "execPath": "bazel-out/k8-fastbuild/bin/foo/_cgo_gotypes.go"},
+			{"id": 4, "execPath": "external/go_sdk/src/runtime/cgo/cgo.go"},
+			{"id": 5, "execPath": "bazel-out/k8-fastbuild/bin/foo/foo.a"},
+			{"id": 6, "execPath": "foo/foo_test.go"},
+			{"id": 7, "execPath": "foo/x_test.go"},
+			{"id": 8, "execPath": "bazel-out/k8-fastbuild/bin/foo/foo_test_/testmain.go"},
+			{"id": 9, "execPath": "baz/baz.go"},
+			{"id": 10, "execPath": "baz/cgo.go"}
+		],
+		"depSetOfFiles": [
+			{"id": 1, "directArtifactIds": [1, 2], "transitiveDepSetIds": [2]},
+			{"id": 2, "directArtifactIds": [3, 4]},
+			{"id": 3, "directArtifactIds": [1, 6], "transitiveDepSetIds": [2]},
+			{"id": 4, "directArtifactIds": [5, 7]},
+			{"id": 5, "directArtifactIds": [5, 8]},
+			{"id": 6, "directArtifactIds": [9, 10]}
+		],
+		"actions": [
+			{"targetId": 1, "mnemonic": "GoCompilePkg", "inputDepSetIds": [1]},
+			{"targetId": 2, "mnemonic": "GoCompilePkg", "inputDepSetIds": [5]},
+			{"targetId": 2, "mnemonic": "GoCompilePkg", "inputDepSetIds": [3]},
+			{"targetId": 2, "mnemonic": "GoCompilePkg", "inputDepSetIds": [4]},
+			{"targetId": 3, "mnemonic": "GoCompilePkg", "inputDepSetIds": [6]}
+		],
+		"targets": [
+			{"id": 1, "label": "//foo:foo"},
+			{"id": 2, "label": "//foo:foo_test"},
+			{"id": 3, "label": "//baz:baz"}
+		]
+	}`
+	d := newTestDriver("/ws", &fakeBazel{aquery: []byte(aquery)}, packages.NeedCompiledGoFiles)
+	d.execRoot = "/output/execroot/ws"
+	d.sdk.goroot = "/output/execroot/ws/external/go_sdk"
+	pkgs := []*packages.Package{
+		{ID: "//foo:foo", GoFiles: []string{"/ws/foo/foo.go", "/ws/foo/cgo.go"}},
+		{ID: "example.com/foo [//foo:foo_test]", GoFiles: []string{"/ws/foo/foo.go", "/ws/foo/cgo.go", "/ws/foo/foo_test.go"}},
+		{ID: "example.com/foo_test [//foo:foo_test]", GoFiles: []string{"/ws/foo/x_test.go"}},
+		{ID: "//foo:foo_test", GoFiles: []string{"/output/execroot/ws/bazel-out/k8-fastbuild/bin/foo/foo_test_/testmain.go"}},
+		{ID: "//bar:bar", GoFiles: []string{"/ws/bar/bar.go"}},
+		{
+			ID:              "//baz:baz",
+			GoFiles:         []string{"/ws/baz/baz.go", "/ws/baz/cgo.go"},
+			CompiledGoFiles: []string{"/ws/baz/baz.go", "bazel-bin/baz/cgo.cgo1.go"},
+		},
+	}
+	compiled, err := d.compiledFiles(packageLabels(pkgs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.setCompiledGoFiles(pkgs, compiled)
+
+	const bin = "/output/execroot/ws/bazel-out/k8-fastbuild/bin/foo/"
+	want := map[string][]string{
+		"//foo:foo":                             {"/ws/foo/foo.go", bin + "cgo.cgo1.go", bin + "_cgo_gotypes.go"},
+		"example.com/foo [//foo:foo_test]":      {"/ws/foo/foo.go", "/ws/foo/foo_test.go", bin + "_cgo_gotypes.go"},
+		"example.com/foo_test [//foo:foo_test]": nil,
+		"//foo:foo_test":                        nil,
+		"//bar:bar":                             nil,
+		// The compile action has no cgo outputs, so Load's files are kept.
+		"//baz:baz": {"/ws/baz/baz.go", "bazel-bin/baz/cgo.cgo1.go"},
+	}
+	for _, pkg := range pkgs {
+		if !reflect.DeepEqual(pkg.CompiledGoFiles, want[pkg.ID]) {
+			t.Errorf("%v: CompiledGoFiles = %v, want %v", pkg.ID, pkg.CompiledGoFiles, want[pkg.ID])
+		}
+	}
+}
+
+func TestLoadPackagesUnsupportedMode(t *testing.T) {
+	d := newTestDriver(testWorkspace(t), &fakeBazel{}, packages.NeedName|1<<30)
+	if _, err := d.loadPackages("./..."); err == nil {
+		t.Error("loadPackages succeeded with an unsupported mode")
+	}
+}
+
+func TestLoadPackagesFileErrors(t *testing.T) {
+	root := testWorkspace(t)
+	files := map[string]string{
+		"foo/broken.go": "packag foo\n",
+		"foo/fmt.go":    "package foo\n\nimport \"fmt\"\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	foo := rule("go_library", "//foo:foo", filepath.Join(root, "foo/BUILD.bazel:1:11"),
+		stringAttr("importpath", "example.com/foo"),
+		listAttr("srcs", "//foo:broken.go", "//foo:generated.go", "//foo:fmt.go"),
+	)
+	bzl := &fakeBazel{queries: map[string][]*blaze_query.Target{goFilter("//..."): {foo}}}
+	d := newTestDriver(root, bzl, packages.NeedName|packages.NeedFiles|packages.NeedImports)
+	resp, err := d.loadPackages("./...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkg *packages.Package
+	for _, p := range resp.Packages {
+		if p.ID == "//foo:foo" {
+			pkg = p
+		}
+	}
+	if pkg == nil {
+		t.Fatalf("//foo:foo is missing from %v", resp.Packages)
+	}
+	if pkg.Name != "foo" || pkg.Imports["fmt"] == nil {
+		t.Errorf("got package %v with imports %v, want foo importing fmt", pkg.Name, pkg.Imports)
+	}
+	if len(bzl.builds) != 1 {
+		t.Errorf("got builds %v, want one build for the missing file", bzl.builds)
+	}
+	if len(pkg.Errors) != 2 {
+		t.Fatalf("Errors = %v, want 2 errors", pkg.Errors)
+	}
+	if e := pkg.Errors[0]; e.Kind != packages.ParseError || e.Pos != filepath.Join(root, "foo/broken.go:1:1") {
+		t.Errorf("got %#v, want a parse error in broken.go", e)
+	}
+	if e := pkg.Errors[1]; e.Kind != packages.ListError || !strings.Contains(e.Msg, "generated.go") {
+		t.Errorf("got %#v, want an error for generated.go", e)
+	}
+}
+
+func TestLoadPackagesQueryErrors(t *testing.T) {
+	root := testWorkspace(t)
+	foo := rule("go_library", "//foo:foo", filepath.Join(root, "foo/BUILD.bazel:1:11"),
+		stringAttr("importpath", "example.com/foo"),
+		listAttr("srcs", "//foo:foo.go"),
+	)
+	fooTest := rule("go_test", "//foo:foo_test", filepath.Join(root, "foo/BUILD.bazel:7:8"),
+		listAttr("srcs", "//foo:foo_test.go"),
+		listAttr("embed", "//foo:foo"),
+	)
+	if err := ioutil.WriteFile(filepath.Join(root, "foo/foo_test.go"), []byte("package foo\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	fooErr := packages.Error{Pos: filepath.Join(root, "foo/BUILD.bazel:3:11"), Msg: "no such target '//bar:baz'", Kind: packages.ListError}
+	barErr := packages.Error{Pos: filepath.Join(root, "bar/BUILD.bazel:1:1"), Msg: "syntax error", Kind: packages.ListError}
+	extErr := packages.Error{Pos: filepath.Join(filepath.Dir(root), "external/ext/BUILD.bazel:1:1"), Msg: "syntax error", Kind: packages.ListError}
+	queryErr := packages.Error{Msg: "query failed", Kind: packages.ListError}
+	bzl := &fakeBazel{
+		queries: map[string][]*blaze_query.Target{goFilter("//..."): {foo, fooTest}},
+		errors:  map[string][]packages.Error{goFilter("//..."): {fooErr, barErr, extErr, queryErr}},
+	}
+	d := newTestDriver(root, bzl, packages.NeedName|packages.NeedFiles)
+	resp, err := d.loadPackages("./...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(resp.Roots)
+	if want := []string{"//bar", "//foo:foo", "//foo:foo_test"}; !reflect.DeepEqual(resp.Roots, want) {
+		t.Errorf("Roots = %v, want %v", resp.Roots, want)
+	}
+	want := map[string][]packages.Error{
+		"//foo:foo":                        {fooErr, queryErr},
+		"example.com/foo [//foo:foo_test]": {fooErr},
+		"//bar":                            {barErr, queryErr},
+		"@ext//":                           {extErr},
+	}
+	for _, pkg := range resp.Packages {
+		if pkg.ID == "//foo:foo_test" {
+			// The testmain has its own error for the missing testmain.go.
+			continue
+		}
+		if !reflect.DeepEqual(pkg.Errors, want[pkg.ID]) {
+			t.Errorf("%v: Errors = %v, want %v", pkg.ID, pkg.Errors, want[pkg.ID])
+		}
+	}
+	if len(d.ws.Packages) != 0 {
+		t.Errorf("partial results were cached: %v", d.ws.Packages)
+	}
+}
+
+func TestFileIndex(t *testing.T) {
+	root := testWorkspace(t)
+	foo := rule("go_library", "//foo:foo", filepath.Join(root, "foo/BUILD.bazel:1:11"),
+		listAttr("srcs", "//foo:foo.go", "//foo:new.go"),
+	)
+	barErr := packages.Error{Pos: filepath.Join(root, "bar/BUILD.bazel:1:1"), Msg: "syntax error", Kind: packages.ListError}
+	bzl := &fakeBazel{
+		queries: map[string][]*blaze_query.Target{goFilter("//..."): {foo}},
+		errors:  map[string][]packages.Error{goFilter("//..."): {barErr}},
+	}
+	d := newTestDriver(root, bzl, packages.NeedName)
+	lookup := func(filename string) []string {
+		t.Helper()
+		index, err := d.fileIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return index.Files[filename]
+	}
+
+	if got, want := lookup("foo/foo.go"), []string{"//foo:foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("index[foo/foo.go] = %v, want %v", got, want)
+	}
+	if got := lookup("bar/bar.go"); got != nil {
+		t.Errorf("index[bar/bar.go] = %v, want nothing", got)
+	}
+	if len(bzl.ran) != 1 {
+		t.Errorf("ran %d queries, want the partial index to be reused: %v", len(bzl.ran), bzl.ran)
+	}
+	if len(d.queryErrors) != 0 {
+		t.Errorf("queryErrors = %v, want the index errors to be ignored", d.queryErrors)
+	}
+
+	// Fixing the broken BUILD file rebuilds the index.
+	if err := ioutil.WriteFile(filepath.Join(root, "bar/BUILD.bazel"), []byte("go_library(name = \"bar\")\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	delete(bzl.errors, goFilter("//..."))
+	lookup("foo/foo.go")
+	if len(bzl.ran) != 2 {
+		t.Errorf("ran %d queries, want the index to be rebuilt after bar/BUILD.bazel changed", len(bzl.ran))
+	}
+
+	// So does changing a BUILD file that defines a target in the index.
+	if err := ioutil.WriteFile(filepath.Join(root, "foo/BUILD.bazel"), []byte("# changed\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	lookup("foo/foo.go")
+	lookup("foo/foo.go")
+	if len(bzl.ran) != 3 {
+		t.Errorf("ran %d queries, want 3", len(bzl.ran))
+	}
+}
+
+func TestQueryStamps(t *testing.T) {
+	root := testWorkspace(t)
+	if err := os.MkdirAll(filepath.Join(root, "foo/sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	d := newTestDriver(root, &fakeBazel{}, packages.NeedName)
+	dirs := func(expr string) []string {
+		var result []string
+		for filename := range d.queryStamps(expr, &blaze_query.QueryResult{}) {
+			rel, _ := filepath.Rel(root, filename)
+			result = append(result, filepath.ToSlash(rel))
+		}
+		sort.Strings(result)
+		return result
+	}
+	tests := map[string][]string{
+		goFilter("//foo/..."):                            {"foo", "foo/sub"},
+		goFilter("//bar:all"):                            {"bar"},
+		goFilter("//bar:*") + " + " + goFilter("//:all"): {".", "bar"},
+		goFilter("//foo:foo"):                            nil,
+		goFilter("@ext//..."):                            nil,
+		goFilter("//..."):                                {".", "bar", "external", "foo", "foo/sub"},
+	}
+	for expr, want := range tests {
+		if got := dirs(expr); !reflect.DeepEqual(got, want) {
+			t.Errorf("queryStamps(%v) = %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestSavePackages(t *testing.T) {
+	root := testWorkspace(t)
+	cgoFile := filepath.Join(root, "foo/foo.go")
+	d := newTestDriver(root, &fakeBazel{}, packages.NeedName)
+	result := &blaze_query.QueryResult{Target: []*blaze_query.Target{
+		rule("go_library", "//foo:foo", filepath.Join(root, "foo/BUILD.bazel:1:11")),
+	}}
+	pkgs := []*packages.Package{{ID: "//foo:foo", GoFiles: []string{cgoFile}}}
+	d.savePackages("//foo:foo", result, pkgs, []string{cgoFile})
+
+	if got := d.cachedPackages("//foo:foo"); len(got) != 1 || got[0].ID != "//foo:foo" {
+		t.Fatalf("cachedPackages() = %v, want the saved packages", got)
+	}
+	other := newTestDriver(root, &fakeBazel{}, packages.NeedName)
+	other.cfg.Env = append(other.cfg.Env, "GOOS=plan9")
+	other.ws = d.ws
+	if got := other.cachedPackages("//foo:foo"); got != nil {
+		t.Errorf("cachedPackages() for another GOOS = %v, want nil", got)
+	}
+
+	// The contents of a file that was read are part of the result.
+	if err := ioutil.WriteFile(cgoFile, []byte("package foo\n\nimport \"C\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.cachedPackages("//foo:foo"); got != nil {
+		t.Errorf("cachedPackages() after %v changed = %v, want nil", cgoFile, got)
+	}
+
+	d.savePackages("//foo:foo", result, pkgs, []string{cgoFile})
+	if err := ioutil.WriteFile(filepath.Join(root, "foo/BUILD.bazel"), []byte("# changed\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.cachedPackages("//foo:foo"); got != nil {
+		t.Errorf("cachedPackages() after the BUILD file changed = %v, want nil", got)
+	}
+}
+
+func TestSaveWorkspace(t *testing.T) {
+	root := testWorkspace(t)
+	d := newTestDriver(root, &fakeBazel{}, packages.NeedName)
+	ws := d.ws
+	ws.cacheFile = filepath.Join(root, "cache", "workspace.json")
+	ws.Stamps = map[string]fileStamp{filepath.Join(root, "WORKSPACE"): newStamp(filepath.Join(root, "WORKSPACE"))}
+	ws.Stdlib = []string{"fmt"}
+	d.savePackages("//foo:foo", &blaze_query.QueryResult{}, []*packages.Package{{ID: "//foo:foo"}}, nil)
+	if err := ws.save(); err != nil {
+		t.Fatal(err)
+	}
+	if ws.dirty {
+		t.Error("workspace is still dirty after save")
+	}
+
+	loaded := readWorkspace(ws.cacheFile)
+	if loaded == nil {
+		t.Fatal("readWorkspace() = nil, want the saved workspace")
+	}
+	if !loaded.sdk.packages["fmt"] || loaded.Packages[d.packagesKey("//foo:foo")] == nil {
+		t.Errorf("readWorkspace() = %+v, want the sdk and packages that were saved", loaded)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, "WORKSPACE"), []byte("workspace(name = \"x\")\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := readWorkspace(ws.cacheFile); loaded != nil {
+		t.Error("readWorkspace() after WORKSPACE changed returned the saved workspace")
+	}
+}
+
+func TestBazelBin(t *testing.T) {
+	root := testWorkspace(t)
+	bzl := &fakeBazel{info: map[string]string{"bazel-bin": "/out/bin"}}
+	d := newTestDriver(root, bzl, packages.NeedFiles)
+	if got := d.bazelBin(); got != "" || bzl.bazelBins != 0 {
+		t.Errorf("bazelBin() = %q after %d calls, want the bazel-bin symlink without calling bazel", got, bzl.bazelBins)
+	}
+	d.ws.OwnOutputBase = true
+	d.ws.BazelBin = make(map[string]string)
+	for _, flags := range [][]string{{"-tags=x"}, nil, {"--config=arm"}, {"--config=arm", "-tags=y"}} {
+		d.cfg.BuildFlags = flags
+		if got := d.bazelBin(); got != "/out/bin" {
+			t.Errorf("bazelBin() with %q = %q, want /out/bin", flags, got)
+		}
+	}
+	// The go flags don't change the configuration, so only --config=arm needs another bazel info.
+	if bzl.bazelBins != 2 {
+		t.Errorf("ran bazel info bazel-bin %d times, want 2", bzl.bazelBins)
+	}
+}
+
+func TestBuildFileLabel(t *testing.T) {
+	d := &bazelDriver{workspaceRoot: "/ws", execRoot: "/output/execroot/ws"}
+	tests := map[string]string{
+		"/ws/BUILD.bazel":   "//",
+		"/ws/foo/bar/BUILD": "//foo/bar",
+		"/output/external/com_github_foo/BUILD.bazel": "@com_github_foo//",
+		"/output/external/com_github_foo/x/BUILD":     "@com_github_foo//x",
+		"/elsewhere/BUILD":                            "/elsewhere",
+	}
+	for filename, want := range tests {
+		if got := d.buildFileLabel(filename); got != want {
+			t.Errorf("buildFileLabel(%v) = %v, want %v", filename, got, want)
+		}
+	}
+}
+
+func TestIncludeInRoots(t *testing.T) {
+	const root = "/ws"
+	tests := []struct {
+		name           string
+		packageQueries []string
+		importQueries  []string
+		importPatterns []string
+		fileQueries    []string
+		pkg            *packages.Package
+		want           bool
+	}{
+		{
+			name:           "wildcard workspace package",
+			packageQueries: []string{"//..."},
+			pkg:            &packages.Package{ID: "//foo:foo"},
+			want:           true,
+		},
+		{
+			name:           "wildcard external package",
+			packageQueries: []string{"//..."},
+			pkg:            &packages.Package{ID: "@ext//foo:foo"},
+		},
+		{
+			name:           "directory",
+			packageQueries: []string{"//foo"},
+			pkg:            &packages.Package{ID: "//foo:foo"},
+			want:           true,
+		},
+		{
+			name:           "subdirectory of directory",
+			packageQueries: []string{"//foo"},
+			pkg:            &packages.Package{ID: "//foo/bar:bar"},
+		},
+		{
+			name:           "subtree",
+			packageQueries: []string{"//foo/..."},
+			pkg:            &packages.Package{ID: "//foo/bar:bar"},
+			want:           true,
+		},
+		{
+			name:           "outside subtree",
+			packageQueries: []string{"//foo/..."},
+			pkg:            &packages.Package{ID: "//foobar:foobar"},
+		},
+		{
+			name:          "import path",
+			importQueries: []string{"example.com/foo"},
+			pkg:           &packages.Package{ID: "//foo:foo", PkgPath: "example.com/foo"},
+			want:          true,
+		},
+		{
+			name:           "import path pattern",
+			importPatterns: []string{"example.com/foo/..."},
+			pkg:            &packages.Package{ID: "//foo/bar:bar", PkgPath: "example.com/foo/bar"},
+			want:           true,
+		},
+		{
+			name:           "import path outside pattern",
+			importPatterns: []string{"example.com/foo/..."},
+			pkg:            &packages.Package{ID: "//foo2:foo2", PkgPath: "example.com/foo2"},
+		},
+		{
+			name:          "other import path",
+			importQueries: []string{"example.com/foo"},
+			pkg:           &packages.Package{ID: "//bar:bar", PkgPath: "example.com/bar"},
+		},
+		{
+			name:        "relative file",
+			fileQueries: []string{"foo/foo.go"},
+			pkg:         &packages.Package{ID: "//foo:foo", GoFiles: []string{"/ws/foo/foo.go"}},
+			want:        true,
+		},
+		{
+			name:        "file in other package",
+			fileQueries: []string{"foo/foo.go"},
+			pkg:         &packages.Package{ID: "//bar:bar", GoFiles: []string{"/ws/bar/bar.go"}},
+		},
+		{
+			name:        "file in external package",
+			fileQueries: []string{"foo/foo.go"},
+			pkg:         &packages.Package{ID: "@ext//foo:foo", GoFiles: []string{"/ws/foo/foo.go"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDriver(root, &fakeBazel{}, 0)
+			for _, q := range tc.packageQueries {
+				d.packageQueries[q] = true
+			}
+			for _, q := range tc.importQueries {
+				d.importQueries[q] = true
+			}
+			for _, q := range tc.importPatterns {
+				d.importPatterns = append(d.importPatterns, regexp.MustCompile(importPathRegexp(q)))
+			}
+			for _, q := range tc.fileQueries {
+				d.fileQueries[q] = true
+			}
+			if got := d.includeInRoots(tc.pkg); got != tc.want {
+				t.Errorf("includeInRoots(%v) = %v, want %v", tc.pkg.ID, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIncludeInRootsKeepsFiles(t *testing.T) {
+	d := newTestDriver("/ws", &fakeBazel{}, packages.NeedFiles)
+	d.fileQueries["foo/ignored.go"] = true
+	// CompiledGoFiles shares the array of GoFiles, which has room for more files.
+	files := make([]string, 1, 2)
+	files[0] = "/ws/foo/foo.go"
+	pkg := &packages.Package{
+		ID:              "//foo:foo",
+		GoFiles:         files,
+		CompiledGoFiles: files[:2],
+		IgnoredFiles:    []string{"/ws/foo/ignored.go"},
+	}
+	pkg.CompiledGoFiles[1] = "/out/foo/cgo.cgo1.go"
+	if !d.includeInRoots(pkg) {
+		t.Error("includeInRoots() = false for a package with an ignored file from a file= pattern")
+	}
+	if want := []string{"/ws/foo/foo.go", "/out/foo/cgo.cgo1.go"}; !reflect.DeepEqual(pkg.CompiledGoFiles, want) {
+		t.Errorf("CompiledGoFiles = %v after includeInRoots, want %v", pkg.CompiledGoFiles, want)
+	}
+}
+
+func TestNotBazelWorkspace(t *testing.T) {
+	var cache workspaces
+	ws, err := cache.get(testWorkspace(t), &driver.Request{}, &config{}, &fakeBazel{})
+	if err != nil || ws != nil {
+		t.Errorf("get() = %v, %v, want nil workspace", ws, err)
+	}
+}
+
+func TestWriteAspectRepo(t *testing.T) {
+	cache, err := ioutil.TempDir("", "bazelpackagesdriver-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(cache) })
+
+	bzl := &fakeBazel{queries: map[string][]*blaze_query.Target{
+		"@io_bazel_rules_go//go:def.bzl": {},
+		"@rules_go//go:def.bzl":          {sourceFile("@rules_go//go:def.bzl", "/output/external/rules_go/go/BUILD.bazel:1:1")},
+	}}
+	rulesGo, err := newTestDriver("/ws", bzl, packages.NeedName).rulesGoRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rulesGo != "@rules_go" {
+		t.Errorf("rulesGoRepo() = %v, want @rules_go", rulesGo)
+	}
+
+	dir, err := writeAspectRepo(cache, rulesGo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build, err := ioutil.ReadFile(filepath.Join(dir, "BUILD.bazel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(build), `load("@rules_go//go:def.bzl"`) {
+		t.Errorf("BUILD.bazel doesn't load @rules_go:\n%s", build)
+	}
+	if again, err := writeAspectRepo(cache, rulesGo); err != nil || again != dir {
+		t.Errorf("writeAspectRepo() = %v, %v, want %v", again, err, dir)
+	}
+	if other, err := writeAspectRepo(cache, "@io_bazel_rules_go"); err != nil || other == dir {
+		t.Errorf("writeAspectRepo(@io_bazel_rules_go) = %v, %v, want a different directory", other, err)
+	}
+}
+
+func TestAspectTargets(t *testing.T) {
+	d := newTestDriver("/ws", &fakeBazel{}, packages.NeedName)
+	d.kinds = pkgconv.RuleKinds{"company_go_library": {Like: "library"}}
+	result := &blaze_query.QueryResult{Target: []*blaze_query.Target{
+		rule("go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:11"),
+		rule("company_go_library", "//foo:custom", "/ws/foo/BUILD.bazel:5:19"),
+		rule("alias", "//foo:alias", "/ws/foo/BUILD.bazel:9:6"),
+		rule("proto_library", "//foo:foo_proto", "/ws/foo/BUILD.bazel:13:14"),
+		sourceFile("//foo:foo.go", "/ws/foo/foo.go:1:1"),
+	}}
+	if got, want := d.aspectTargets(result), []string{"//foo:foo", "//foo:custom", "//foo:alias"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("aspectTargets() = %v, want %v", got, want)
+	}
+}
+
+func TestAspectToPackages(t *testing.T) {
+	tests := []struct {
+		name  string
+		kinds pkgconv.RuleKinds
+		info  string
+		want  []*packages.Package
+	}{
+		{
+			name: "go_library",
+			info: `{
+				"label": "@@//foo:foo",
+				"kind": "go_library",
+				"importpath": "example.com/foo",
+				"compiled_go_files": ["foo/foo.go", "bazel-out/k8-fastbuild/bin/foo/gen.go", "foo/foo_windows.go"],
+				"other_files": ["foo/foo.h"],
+				"deps": [{"importpath": "example.com/bar", "label": "@//bar:bar"}],
+				"files": [
+					{"path": "foo/foo.go", "package": "foo", "imports": ["fmt", "example.com/bar", "example.com/missing"]},
+					{"path": "bazel-out/k8-fastbuild/bin/foo/gen.go", "package": "foo"},
+					{"path": "foo/foo_windows.go", "package": "foo"}
+				]
+			}`,
+			want: []*packages.Package{{
+				ID:              "//foo:foo",
+				PkgPath:         "example.com/foo",
+				Name:            "foo",
+				GoFiles:         []string{"/ws/foo/foo.go", "/output/execroot/ws/bazel-out/k8-fastbuild/bin/foo/gen.go"},
+				CompiledGoFiles: []string{"/ws/foo/foo.go", "/output/execroot/ws/bazel-out/k8-fastbuild/bin/foo/gen.go"},
+				OtherFiles:      []string{"/ws/foo/foo.h"},
+				IgnoredFiles:    []string{"/ws/foo/foo_windows.go"},
+				Imports:         map[string]*packages.Package{"fmt": {ID: "fmt"}, "example.com/bar": {ID: "//bar:bar"}},
+			}},
+		},
+		{
+			name:  "custom go_test",
+			kinds: pkgconv.RuleKinds{"company_go_test": {Like: "test"}},
+			info: `{
+				"label": "//foo:foo_test",
+				"kind": "company_go_test",
+				"importpath": "example.com/foo",
+				"compiled_go_files": ["foo/foo.go", "foo/foo_test.go", "foo/x_test.go"],
+				"files": [
+					{"path": "foo/foo.go", "package": "foo"},
+					{"path": "foo/foo_test.go", "package": "foo", "imports": ["fmt"]},
+					{"path": "foo/x_test.go", "package": "foo_test", "imports": ["example.com/foo"]}
+				]
+			}`,
+			want: []*packages.Package{
+				{
+					ID:              "example.com/foo [//foo:foo_test]",
+					PkgPath:         "example.com/foo",
+					Name:            "foo",
+					GoFiles:         []string{"/ws/foo/foo.go", "/ws/foo/foo_test.go"},
+					CompiledGoFiles: []string{"/ws/foo/foo.go", "/ws/foo/foo_test.go"},
+					Imports:         map[string]*packages.Package{"fmt": {ID: "fmt"}},
+				},
+				{
+					ID:              "example.com/foo_test [//foo:foo_test]",
+					PkgPath:         "example.com/foo_test",
+					Name:            "foo_test",
+					GoFiles:         []string{"/ws/foo/x_test.go"},
+					CompiledGoFiles: []string{"/ws/foo/x_test.go"},
+					Imports:         map[string]*packages.Package{"example.com/foo": {ID: "example.com/foo [//foo:foo_test]"}},
+				},
+			},
+		},
+		{
+			name: "only ignored files",
+			info: `{
+				"label": "//foo:foo",
+				"kind": "go_library",
+				"importpath": "example.com/foo",
+				"compiled_go_files": ["foo/foo_windows.go"],
+				"files": [{"path": "foo/foo_windows.go", "package": "foo"}]
+			}`,
+			want: []*packages.Package{{
+				ID:           "//foo:foo",
+				PkgPath:      "example.com/foo",
+				Name:         "foo",
+				IgnoredFiles: []string{"/ws/foo/foo_windows.go"},
+				Imports:      map[string]*packages.Package{},
+			}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDriver("/ws", &fakeBazel{}, packages.NeedName|packages.NeedFiles|packages.NeedImports)
+			d.cfg.Env = []string{"GOOS=linux", "GOARCH=amd64"}
+			d.execRoot = "/output/execroot/ws"
+			d.kinds = tc.kinds
+			var info aspectPackage
+			if err := json.Unmarshal([]byte(tc.info), &info); err != nil {
+				t.Fatal(err)
+			}
+			info.Label = normalizeLabel(info.Label)
+			if got := d.aspectToPackages(&info); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("aspectToPackages() =\n%v\nwant\n%v", dumpPackages(got), dumpPackages(tc.want))
+			}
+		})
+	}
+}
+
+func TestPackagesFromAspect(t *testing.T) {
+	root := testWorkspace(t)
+	cache := filepath.Join(root, "cache")
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", cache)
+
+	// The aspect writes a json file for each target.
+	infos := map[string]string{
+		"foo.json": `{"label": "@//foo:foo", "kind": "go_library", "importpath": "example.com/foo",
+			"compiled_go_files": ["foo/foo.go"],
+			"deps": [{"importpath": "example.com/bar", "label": "@//bar:bar"}],
+			"files": [{"path": "foo/foo.go", "package": "foo", "imports": ["example.com/bar"]}]}`,
+		"bar.json": `{"label": "@//bar:bar", "kind": "go_library", "importpath": "example.com/bar",
+			"compiled_go_files": ["bar/bar.go"],
+			"files": [{"path": "bar/bar.go", "package": "bar"}]}`,
+	}
+	for name, info := range infos {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(info), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := []string{
+		fmt.Sprintf(`{"id": {"namedSet": {"id": "1"}}, "namedSetOfFiles": {"files": [{"name": "bar.json", "uri": "file://%v/bar.json"}]}}`, root),
+		fmt.Sprintf(`{"id": {"namedSet": {"id": "2"}}, "namedSetOfFiles": {"files": [{"name": "foo.json", "uri": "file://%v/foo.json"}], "fileSets": [{"id": "1"}]}}`, root),
+		`{"id": {"targetCompleted": {"label": "@//foo:foo"}}, "completed": {"outputGroup": [{"name": "bazelpackagesdriver", "fileSets": [{"id": "2"}]}]}}`,
+	}
+	bzl := &fakeBazel{
+		queries: map[string][]*blaze_query.Target{
+			goFilter("//foo:foo"):            {rule("go_library", "//foo:foo", filepath.Join(root, "foo/BUILD.bazel:1:11"))},
+			"@io_bazel_rules_go//go:def.bzl": {sourceFile("@io_bazel_rules_go//go:def.bzl", "/output/external/io_bazel_rules_go/go/BUILD.bazel:1:1")},
+		},
+		events: strings.Join(events, "\n"),
+	}
+
+	for _, tc := range []struct {
+		mode packages.LoadMode
+		want []string
+	}{
+		{mode: packages.NeedName | packages.NeedImports, want: []string{"//foo:foo"}},
+		{mode: packages.NeedName | packages.NeedImports | packages.NeedDeps, want: []string{"//bar:bar", "//foo:foo"}},
+	} {
+		d := newTestDriver(root, bzl, tc.mode)
+		pkgs, roots, err := d.packagesFromAspect([]string{"//foo:foo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(roots, []string{"//foo:foo"}) {
+			t.Errorf("%v: roots = %v, want //foo:foo", tc.mode, roots)
+		}
+		var ids []string
+		for _, pkg := range pkgs {
+			ids = append(ids, pkg.ID)
+			if pkg.ID == "//foo:foo" && (pkg.Imports["example.com/bar"] == nil || pkg.Imports["example.com/bar"].ID != "//bar:bar") {
+				t.Errorf("%v: //foo:foo imports %v, want example.com/bar from //bar:bar", tc.mode, pkg.Imports)
+			}
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, tc.want) {
+			t.Errorf("%v: packages = %v, want %v", tc.mode, ids, tc.want)
+		}
+	}
+	build := bzl.builds[0]
+	if !containsString(build, "--aspects="+aspectName) || !containsString(build, "--output_groups="+aspectOutputGroup) {
+		t.Errorf("bazel build %v, want the aspect and its output group", build)
+	}
+}
+func TestFindGoroot(t *testing.T) {
+	const repo = "@@rules_go~~go_sdk~go_default_sdk"
+	bzl := &fakeBazel{queries: map[string][]*blaze_query.Target{
+		repo + "//:ROOT": {sourceFile(repo+"//:ROOT", "/output/external/rules_go~~go_sdk~go_default_sdk/ROOT:1:1")},
+	}}
+	gotRepo, goroot, err := findGoroot(&driver.Request{}, bzl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotRepo != repo || goroot != "/output/external/rules_go~~go_sdk~go_default_sdk" {
+		t.Errorf("findGoroot() = %v, %v", gotRepo, goroot)
+	}
+
+	// The repository in the request env is the only one that's used.
+	bzl.queries["@my_sdk//:ROOT"] = []*blaze_query.Target{sourceFile("@my_sdk//:ROOT", "/output/external/my_sdk/ROOT:1:1")}
+	cfg := &driver.Request{Env: []string{"GOPACKAGESDRIVER_GO_SDK=my_sdk"}}
+	if gotRepo, gotRoot, err := findGoroot(cfg, bzl); err != nil || gotRepo != "@my_sdk" || gotRoot != "/output/external/my_sdk" {
+		t.Errorf("findGoroot() with GOPACKAGESDRIVER_GO_SDK = %v, %v, %v", gotRepo, gotRoot, err)
+	}
+
+	sdk := &gosdk{goroot: goroot}
+	tests := map[string]string{
+		"bazel-ws/external/rules_go~~go_sdk~go_default_sdk/src/fmt/print.go": "bazel-ws/external/rules_go~~go_sdk~go_default_sdk",
+		"bazel-ws/external/go_sdk/src/fmt/print.go":                          "",
+		"bazel-ws/external/other/foo.go":                                     "",
+		"foo/external/rules_go~~go_sdk~go_default_sdk/foo.go":                "",
+	}
+	for filename, want := range tests {
+		if got := sdk.gorootPrefix(filename); got != want {
+			t.Errorf("gorootPrefix(%v) = %#v, want %#v", filename, got, want)
+		}
+	}
+}
+
+func TestAddModules(t *testing.T) {
+	bzl := &fakeBazel{queries: map[string][]*blaze_query.Target{
+		goRepositoryQuery: {
+			rule("go_repository", "//external:com_github_foo", "/ws/WORKSPACE:10:14",
+				stringAttr("importpath", "github.com/foo"),
+				stringAttr("version", "v1.2.3"),
+				stringAttr("sum", "h1:foo="),
+			),
+			rule("go_repository", "//external:org_example_bar", "/ws/WORKSPACE:20:14",
+				stringAttr("importpath", "example.org/bar"),
+				stringAttr("replace", "example.org/bar-fork"),
+				stringAttr("version", "v0.1.0"),
+				stringAttr("sum", "h1:bar="),
+			),
+		},
+	}}
+	d := newTestDriver("/ws", bzl, packages.NeedModule)
+	d.execRoot = "/output/execroot/ws"
+	pkgs := []*packages.Package{
+		{ID: "@com_github_foo//:foo"},
+		{ID: "@com_github_foo//baz:baz"},
+		{ID: "@org_example_bar//:bar"},
+		{ID: "@other//:other"},
+		{ID: "//foo:foo"},
+	}
+	d.addModules(pkgs)
+
+	foo := &packages.Module{Path: "github.com/foo", Version: "v1.2.3", Dir: "/output/external/com_github_foo"}
+	bar := &packages.Module{
+		Path:    "example.org/bar",
+		Replace: &packages.Module{Path: "example.org/bar-fork", Version: "v0.1.0", Dir: "/output/external/org_example_bar"},
+		Dir:     "/output/external/org_example_bar",
+	}
+	want := []*packages.Module{foo, foo, bar, nil, nil}
+	for i, pkg := range pkgs {
+		if !reflect.DeepEqual(pkg.Module, want[i]) {
+			t.Errorf("%v: Module = %+v, want %+v", pkg.ID, pkg.Module, want[i])
+		}
+	}
+}
+
+func TestLoadPackagesModulesOff(t *testing.T) {
+	root := testWorkspace(t)
+	foo := rule("go_library", "//foo:foo", filepath.Join(root, "foo/BUILD.bazel:1:11"),
+		stringAttr("importpath", "example.com/foo"),
+		listAttr("srcs", "//foo:foo.go"),
+	)
+	if err := ioutil.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{"", modulesEnv + "=on"} {
+		bzl := &fakeBazel{queries: map[string][]*blaze_query.Target{
+			goFilter("//foo:all"): {foo},
+			goRepositoryQuery:     {},
+		}}
+		d := newTestDriver(root, bzl, packages.NeedName|packages.NeedModule)
+		if env != "" {
+			d.cfg.Env = append(d.cfg.Env, env)
+		}
+		resp, err := d.loadPackages("./foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pkg := range resp.Packages {
+			if want := env != ""; (pkg.Module != nil) != want {
+				t.Errorf("with %q, %v has Module %+v", env, pkg.ID, pkg.Module)
+			}
+		}
+		ran := false
+		for _, q := range bzl.ran {
+			ran = ran || q == goRepositoryQuery
+		}
+		if want := env != ""; ran != want {
+			t.Errorf("with %q, ran %v = %v, want %v", env, goRepositoryQuery, ran, want)
+		}
+	}
+}
+
+func TestAddMainModules(t *testing.T) {
+	root := testWorkspace(t)
+	files := map[string]string{
+		"go.mod":           "module example.com // main module\n\ngo 1.21.0\n\ntoolchain go1.22.1\n",
+		"tools/go.mod":     "module \"example.com/tools\"\n\ngo 1.20\n",
+		"foo/foo_test.go":  "package foo\n",
+		"foo/x_test.go":    "package foo_test\n",
+		"tools/gen/gen.go": "package gen\n",
+		"other/other.go":   "package other\n",
+	}
+	if err := os.MkdirAll(filepath.Join(root, "tools", "gen"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "other"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	main := &packages.Module{Path: "example.com", Main: true, Dir: root, GoMod: filepath.Join(root, "go.mod"), GoVersion: "1.21.0"}
+	tools := &packages.Module{Path: "example.com/tools", Main: true, Dir: filepath.Join(root, "tools"), GoMod: filepath.Join(root, "tools", "go.mod"), GoVersion: "1.20"}
+
+	targets := []*blaze_query.Target{
+		rule("go_library", "//foo:foo", filepath.Join(root, "foo/BUILD.bazel:1:11"),
+			stringAttr("importpath", "example.com/foo"),
+			listAttr("srcs", "//foo:foo.go"),
+		),
+		rule("go_test", "//foo:foo_test", filepath.Join(root, "foo/BUILD.bazel:7:8"),
+			listAttr("srcs", "//foo:foo_test.go", "//foo:x_test.go"),
+			listAttr("embed", "//foo:foo"),
+		),
+		rule("go_library", "//tools/gen:gen", filepath.Join(root, "tools/gen/BUILD.bazel:1:11"),
+			stringAttr("importpath", "example.com/tools/gen"),
+			listAttr("srcs", "//tools/gen:gen.go"),
+		),
+		rule("go_library", "//other:other", filepath.Join(root, "other/BUILD.bazel:1:11"),
+			stringAttr("importpath", "example.com.other/x"),
+			listAttr("srcs", "//other:other.go"),
+		),
+		rule("go_library", "@com_github_foo//:foo", filepath.Join(root, "external/com_github_foo/BUILD.bazel:1:11"),
+			stringAttr("importpath", "example.com/vendored"),
+			listAttr("srcs", "@com_github_foo//:foo.go"),
+		),
+	}
+	load := func() map[string]*packages.Module {
+		d := newTestDriver(root, &fakeBazel{}, packages.NeedModule)
+		pkgs := pkgconv.Load(&d.cfg, targets, nil, nil)
+		d.addMainModules(pkgs)
+		modules := make(map[string]*packages.Module)
+		for _, pkg := range pkgs {
+			modules[pkg.ID] = pkg.Module
+		}
+		return modules
+	}
+	check := func(got, want map[string]*packages.Module) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("got %d packages, want %d", len(got), len(want))
+		}
+		for id := range want {
+			if !reflect.DeepEqual(got[id], want[id]) {
+				t.Errorf("%v: Module = %+v, want %+v", id, got[id], want[id])
+			}
+		}
+	}
+
+	check(load(), map[string]*packages.Module{
+		"//foo:foo":                             main,
+		"example.com/foo [//foo:foo_test]":      main,
+		"example.com/foo_test [//foo:foo_test]": main,
+		"//foo:foo_test":                        main,
+		"//tools/gen:gen":                       main,
+		"//other:other":                         nil,
+		"@com_github_foo//:foo":                 nil,
+	})
+
+	work := "go 1.22\n\nuse (\n\t.\n\t./tools // generators\n)\n"
+	if err := ioutil.WriteFile(filepath.Join(root, "go.work"), []byte(work), 0666); err != nil {
+		t.Fatal(err)
+	}
+	main.GoVersion = "1.22"
+	tools.GoVersion = "1.22"
+	check(load(), map[string]*packages.Module{
+		"//foo:foo":                             main,
+		"example.com/foo [//foo:foo_test]":      main,
+		"example.com/foo_test [//foo:foo_test]": main,
+		"//foo:foo_test":                        main,
+		"//tools/gen:gen":                       tools,
+		"//other:other":                         nil,
+		"@com_github_foo//:foo":                 nil,
+	})
+}
+
+func TestImportPathRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{
+			pattern: "github.com/x/y",
+			match:   []string{"github.com/x/y"},
+			noMatch: []string{"github.com/x/y2", "github.com/x/y/z", "githubxcom/x/y"},
+		},
+		{
+			pattern: "github.com/x/y/...",
+			match:   []string{"github.com/x/y", "github.com/x/y/z", "github.com/x/y/z/w"},
+			noMatch: []string{"github.com/x/y2", "github.com/x"},
+		},
+		{
+			pattern: "github.com/.../internal",
+			match:   []string{"github.com/x/internal", "github.com/x/y/internal"},
+			noMatch: []string{"github.com/x/internal/z"},
+		},
+	}
+	for _, tc := range tests {
+		re := regexp.MustCompile(importPathRegexp(tc.pattern))
+		for _, path := range tc.match {
+			if !re.MatchString(path) {
+				t.Errorf("%v doesn't match %v", tc.pattern, path)
+			}
+		}
+		for _, path := range tc.noMatch {
+			if re.MatchString(path) {
+				t.Errorf("%v matches %v", tc.pattern, path)
+			}
+		}
+	}
+}
+
+func TestImportPathQuery(t *testing.T) {
+	d := newTestDriver("/ws", &fakeBazel{}, packages.NeedName)
+	d.kinds = pkgconv.RuleKinds{
+		"company_go_library": {Like: "library", Attrs: map[string]string{"importpath": "import_path"}},
+		"company_go_test":    {Like: "test", Attrs: map[string]string{"importpath": "import_path"}},
+		"buf_go_library":     {Like: "proto"},
+	}
+	deps := fmt.Sprintf("deps(%v)", d.goFilter("//..."))
+	want := fmt.Sprintf(`(attr(import_path, '^example\.com/foo$', %v) + attr(importpath, '^example\.com/foo$', %v))`, deps, deps)
+	if got := d.importPathQuery("example.com/foo"); got != want {
+		t.Errorf("importPathQuery() = %v, want %v", got, want)
+	}
+}
+
+func TestLabelPattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		labels   []string
+		packages []string
+	}{
+		{pattern: "//services/api:api", labels: []string{"//services/api:api"}},
+		{pattern: "//services/api", labels: []string{"//services/api:api"}},
+		{pattern: "@//services/api", labels: []string{"//services/api:api"}},
+		{pattern: "@com_github_foo//:foo", labels: []string{"@com_github_foo//:foo"}},
+		{pattern: "@com_github_foo//", labels: []string{"@com_github_foo//:com_github_foo"}},
+		{pattern: "@com_github_foo", labels: []string{"@com_github_foo//:com_github_foo"}},
+		{pattern: "@@com_github_foo", labels: []string{"@@com_github_foo//:com_github_foo"}},
+		{pattern: "//services/...", packages: []string{"//services/..."}},
+		{pattern: "//services/...:all", packages: []string{"//services/..."}},
+		{pattern: "//services:*", packages: []string{"//services"}},
+		{pattern: "@com_github_foo//...", packages: []string{"@com_github_foo//..."}},
+	}
+	for _, tc := range tests {
+		d := newTestDriver("/ws", &fakeBazel{}, 0)
+		if got, want := d.labelPattern(tc.pattern), goFilter(tc.pattern); got != want {
+			t.Errorf("labelPattern(%v) = %v, want %v", tc.pattern, got, want)
+		}
+		var labels, pkgs []string
+		for l := range d.labelQueries {
+			labels = append(labels, l)
+		}
+		for p := range d.packageQueries {
+			pkgs = append(pkgs, p)
+		}
+		if !reflect.DeepEqual(labels, tc.labels) || !reflect.DeepEqual(pkgs, tc.packages) {
+			t.Errorf("labelPattern(%v) roots = %v, %v, want %v, %v", tc.pattern, labels, pkgs, tc.labels, tc.packages)
+		}
+	}
+
+	d := newTestDriver("/ws", &fakeBazel{}, 0)
+	d.packageQueries["@com_github_foo//..."] = true
+	for id, want := range map[string]bool{
+		"@com_github_foo//:foo":      true,
+		"@com_github_foo//x/y:y":     true,
+		"@com_github_foo2//:foo":     false,
+		"//com_github_foo/x:x":       false,
+		"example.com/x [//x:x_test]": false,
+	} {
+		if got := d.matchPackageQuery(id); got != want {
+			t.Errorf("matchPackageQuery(%v) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestReadOutputGroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string
+		want   map[string][]string
+	}{
+		{
+			name: "nested file sets",
+			events: []string{
+				`{"id": {"namedSet": {"id": "1"}}, "namedSetOfFiles": {"files": [{"name": "foo.a", "uri": "file:///out/foo/foo.a"}], "fileSets": [{"id": "2"}]}}`,
+				`{"id": {"namedSet": {"id": "2"}}, "namedSetOfFiles": {"files": [{"name": "foo.x", "uri": "file:///out/foo/foo.x"}]}}`,
+				`{"id": {"targetCompleted": {"label": "//foo:foo"}}, "completed": {"outputGroup": [{"name": "compilation_outputs", "fileSets": [{"id": "1"}]}]}}`,
+			},
+			want: map[string][]string{"//foo:foo": {"/out/foo/foo.a", "/out/foo/foo.x"}},
+		},
+		{
+			name: "file sets shared between targets",
+			events: []string{
+				`{"id": {"namedSet": {"id": "1"}}, "namedSetOfFiles": {"files": [{"name": "bar.a", "uri": "file:///out/bar/bar.a"}]}}`,
+				`{"id": {"namedSet": {"id": "2"}}, "namedSetOfFiles": {"files": [{"name": "foo.a", "uri": "file:///out/foo/foo.a"}], "fileSets": [{"id": "1"}, {"id": "1"}]}}`,
+				`{"id": {"targetCompleted": {"label": "//bar:bar"}}, "completed": {"outputGroup": [{"name": "compilation_outputs", "fileSets": [{"id": "1"}]}]}}`,
+				`{"id": {"targetCompleted": {"label": "//foo:foo"}}, "completed": {"outputGroup": [{"name": "compilation_outputs", "fileSets": [{"id": "2"}]}]}}`,
+			},
+			want: map[string][]string{
+				"//bar:bar": {"/out/bar/bar.a"},
+				"//foo:foo": {"/out/foo/foo.a", "/out/bar/bar.a"},
+			},
+		},
+		{
+			name: "other output groups and remote files",
+			events: []string{
+				`{"id": {"namedSet": {"id": "1"}}, "namedSetOfFiles": {"files": [{"name": "foo", "uri": "file:///out/foo/foo"}]}}`,
+				`{"id": {"namedSet": {"id": "2"}}, "namedSetOfFiles": {"files": [{"name": "foo.a", "uri": "bytestream://cache/blobs/1234/56"}]}}`,
+				`{"id": {"targetCompleted": {"label": "//foo:foo"}}, "completed": {"outputGroup": [{"name": "default", "fileSets": [{"id": "1"}]}, {"name": "compilation_outputs", "fileSets": [{"id": "2"}]}]}}`,
+			},
+			want: map[string][]string{},
+		},
+		{
+			name: "failed target",
+			events: []string{
+				`{"id": {"namedSet": {"id": "1"}}, "namedSetOfFiles": {"files": [{"name": "bar.a", "uri": "file:///out/bar/bar.a"}]}}`,
+				`{"id": {"targetCompleted": {"label": "//bar:bar"}}, "completed": {"outputGroup": [{"name": "compilation_outputs", "fileSets": [{"id": "1"}]}]}}`,
+				`{"id": {"targetCompleted": {"label": "//foo:foo"}}, "aborted": {"reason": "SKIPPED"}}`,
+			},
+			want: map[string][]string{"//bar:bar": {"/out/bar/bar.a"}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "bazelpackagesdriver-bep-*.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			if _, err := f.WriteString(strings.Join(tc.events, "\n") + "\n"); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			got, err := readOutputGroup(f.Name(), exportOutputGroup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("readOutputGroup() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddExportFiles(t *testing.T) {
+	events := []string{
+		`{"id": {"namedSet": {"id": "1"}}, "namedSetOfFiles": {"files": [{"name": "foo.a", "uri": "file:///out/foo/foo.a"}, {"name": "foo.x", "uri": "file:///out/foo/foo.x"}]}}`,
+		`{"id": {"namedSet": {"id": "2"}}, "namedSetOfFiles": {"files": [{"name": "bar.a", "uri": "file:///out/bar/bar.a"}]}}`,
+		`{"id": {"targetCompleted": {"label": "//foo:foo"}}, "completed": {"outputGroup": [{"name": "compilation_outputs", "fileSets": [{"id": "1"}]}]}}`,
+		`{"id": {"targetCompleted": {"label": "@@//bar:bar"}}, "completed": {"outputGroup": [{"name": "compilation_outputs", "fileSets": [{"id": "2"}]}]}}`,
+	}
+	bzl := &fakeBazel{events: strings.Join(events, "\n")}
+	d := newTestDriver("/ws", bzl, packages.NeedExportsFile)
+	pkgs := []*packages.Package{
+		{ID: "//foo:foo", PkgPath: "example.com/foo"},
+		{ID: "//bar:bar", PkgPath: "example.com/bar"},
+		{ID: "example.com/foo [//foo:foo_test]", PkgPath: "example.com/foo"},
+		{ID: "//foo:foo_test", PkgPath: "example.com/foo.test"},
+	}
+	if err := d.addExportFiles(pkgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(bzl.builds) != 1 {
+		t.Fatalf("got builds %v, want one", bzl.builds)
+	}
+	if got, want := bzl.builds[0][len(bzl.builds[0])-2:], []string{"//foo:foo", "//bar:bar"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("built %v, want %v", got, want)
+	}
+	want := map[string]string{
+		// The .x file only has the export data, so it's used over the archive.
+		"//foo:foo":                        "/out/foo/foo.x",
+		"//bar:bar":                        "/out/bar/bar.a",
+		"example.com/foo [//foo:foo_test]": "",
+		"//foo:foo_test":                   "",
+	}
+	for _, pkg := range pkgs {
+		if pkg.ExportFile != want[pkg.ID] {
+			t.Errorf("%v: ExportFile = %q, want %q", pkg.ID, pkg.ExportFile, want[pkg.ID])
+		}
+	}
+}
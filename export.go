@@ -0,0 +1,187 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// exportOutputGroup is the rules_go output group containing the compiled archive,
+// which includes the export data for the package.
+const exportOutputGroup = "compilation_outputs"
+
+// buildEvent is the subset of the build event protocol needed to find the
+// files built for each target.
+type buildEvent struct {
+	ID struct {
+		NamedSet *struct {
+			ID string `json:"id"`
+		} `json:"namedSet"`
+		TargetCompleted *struct {
+			Label string `json:"label"`
+		} `json:"targetCompleted"`
+	} `json:"id"`
+	NamedSetOfFiles *namedSetOfFiles `json:"namedSetOfFiles"`
+	Completed       *struct {
+		OutputGroup []struct {
+			Name     string      `json:"name"`
+			FileSets []fileSetID `json:"fileSets"`
+		} `json:"outputGroup"`
+	} `json:"completed"`
+}
+
+type fileSetID struct {
+	ID string `json:"id"`
+}
+
+type namedSetOfFiles struct {
+	Files []struct {
+		Name string `json:"name"`
+		URI  string `json:"uri"`
+	} `json:"files"`
+	FileSets []fileSetID `json:"fileSets"`
+}
+
+// usesExportData mirrors go/packages: dependencies are loaded from export data
+// when it's requested explicitly, or when types are needed without the deps' syntax.
+func usesExportData(mode packages.LoadMode) bool {
+	return mode&packages.NeedExportsFile != 0 || mode&packages.NeedTypes != 0 && mode&packages.NeedDeps == 0
+}
+
+// addExportFiles builds the archives for pkgs and sets ExportFile to the
+// archive bazel built for each package.
+// Test packages don't have a separate archive, so they are skipped.
+func (d *bazelDriver) addExportFiles(pkgs []*packages.Package) error {
+	byLabel := make(map[string]*packages.Package)
+	var labels []string
+	for _, pkg := range pkgs {
+		if strings.Contains(pkg.ID, " ") || strings.HasSuffix(pkg.PkgPath, ".test") {
+			continue
+		}
+		byLabel[pkg.ID] = pkg
+		labels = append(labels, pkg.ID)
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+
+	log.Printf("bazel build %v export data for %v packages", exportOutputGroup, len(labels))
+	archives, err := d.buildOutputGroup(exportOutputGroup, nil, labels)
+	if err != nil {
+		return err
+	}
+	for label, files := range archives {
+		pkg := byLabel[label]
+		if pkg == nil {
+			pkg = byLabel[normalizeLabel(label)]
+		}
+		if pkg == nil {
+			continue
+		}
+		for _, f := range files {
+			if strings.HasSuffix(f, ".x") || (strings.HasSuffix(f, ".a") && pkg.ExportFile == "") {
+				pkg.ExportFile = f
+			}
+		}
+	}
+	return nil
+}
+
+// buildOutputGroup builds outputGroup for labels, and returns the files
+// in the output group for each target.
+func (d *bazelDriver) buildOutputGroup(outputGroup string, flags, labels []string) (map[string][]string, error) {
+	events, err := ioutil.TempFile("", "bazelpackagesdriver-bep-*.json")
+	if err != nil {
+		return nil, err
+	}
+	events.Close()
+	defer os.Remove(events.Name())
+
+	args := append([]string{
+		"--keep_going",
+		"--output_groups=" + outputGroup,
+		"--build_event_json_file=" + events.Name(),
+	}, flags...)
+	if _, err := d.bazel.Build(append(args, labels...)...); err != nil {
+		// With --keep_going the targets that did build are still usable.
+		log.Printf("bazel build: %v", err)
+	}
+
+	return readOutputGroup(events.Name(), outputGroup)
+}
+
+// readOutputGroup reads a build event json file and returns the files in
+// the output group for each completed target.
+func readOutputGroup(filename, outputGroup string) (map[string][]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sets := make(map[string]*namedSetOfFiles)
+	outputs := make(map[string][]fileSetID)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var event buildEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		if event.ID.NamedSet != nil && event.NamedSetOfFiles != nil {
+			sets[event.ID.NamedSet.ID] = event.NamedSetOfFiles
+		}
+		if event.ID.TargetCompleted != nil && event.Completed != nil {
+			for _, group := range event.Completed.OutputGroup {
+				if group.Name == outputGroup {
+					label := event.ID.TargetCompleted.Label
+					outputs[label] = append(outputs[label], group.FileSets...)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]string, len(outputs))
+	for label, ids := range outputs {
+		seen := make(map[string]bool)
+		for len(ids) > 0 {
+			id := ids[0].ID
+			ids = ids[1:]
+			set := sets[id]
+			if set == nil || seen[id] {
+				continue
+			}
+			seen[id] = true
+			for _, file := range set.Files {
+				if u, err := url.Parse(file.URI); err == nil && u.Scheme == "file" {
+					result[label] = append(result[label], u.Path)
+				}
+			}
+			ids = append(ids, set.FileSets...)
+		}
+	}
+	return result, nil
+}
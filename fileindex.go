@@ -0,0 +1,113 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"log"
+	"path"
+	"strings"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"golang.org/x/tools/go/packages"
+)
+
+// fileIndex maps workspace relative source paths to the labels of the go rules
+// that have the file in srcs. It's built from a single query of every go rule
+// in the workspace, so file= patterns don't need to run bazel.
+type fileIndex struct {
+	Files  map[string][]string
+	Stamps map[string]fileStamp
+}
+
+// fileIndexAttrs are the attributes that list the sources of a rule.
+var fileIndexAttrs = map[string]bool{
+	"srcs":      true,
+	"embedsrcs": true,
+}
+
+// fileIndex returns the index for the workspace, rebuilding it if any of the
+// BUILD files have changed.
+// Errors in BUILD files aren't reported, since they're usually unrelated to
+// the files being looked up. The index is still saved, and the broken BUILD
+// files are stamped so it's rebuilt when they're fixed.
+func (d *bazelDriver) fileIndex() (*fileIndex, error) {
+	if d.ws.Index != nil && stampsMatch(d.ws.Index.Stamps) {
+		return d.ws.Index, nil
+	}
+	query := d.goFilter("//...")
+	log.Printf("bazel query %#v", query)
+	result, err := d.bazel.Query(query)
+	var broken []packages.Error
+	if qerr, ok := err.(*queryError); ok && result != nil {
+		log.Printf("bazel query %#v returned a partial result: %v", query, qerr)
+		broken, err = qerr.errs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stamps, err := d.buildfileStamps(query, result)
+	if err != nil {
+		return nil, err
+	}
+	addErrorStamps(stamps, broken)
+	index := &fileIndex{
+		Files:  make(map[string][]string),
+		Stamps: stamps,
+	}
+	for _, t := range result.GetTarget() {
+		rule := t.GetRule()
+		if rule == nil {
+			continue
+		}
+		for _, a := range rule.GetAttribute() {
+			if !fileIndexAttrs[d.kinds.AttrName(rule.GetRuleClass(), a.GetName())] {
+				continue
+			}
+			for _, src := range allStrings(a) {
+				if filename := labelPath(src); filename != "" {
+					index.Files[filename] = append(index.Files[filename], rule.GetName())
+				}
+			}
+		}
+	}
+	d.ws.Index = index
+	d.ws.dirty = true
+	return index, nil
+}
+
+// allStrings returns the values of a list attribute, including every branch of any select().
+// A file belongs to a target if it's in any of the branches.
+func allStrings(a *blaze_query.Attribute) []string {
+	result := a.GetStringListValue()
+	for _, sel := range a.GetSelectorList().GetElements() {
+		for _, e := range sel.GetEntries() {
+			result = append(result, e.GetStringListValue()...)
+		}
+	}
+	return result
+}
+
+// labelPath converts a label in the main repository to a workspace relative path.
+func labelPath(label string) string {
+	if !strings.HasPrefix(label, "//") {
+		return ""
+	}
+	label = strings.TrimPrefix(label, "//")
+	parts := strings.SplitN(label, ":", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return path.Join(parts[0], parts[1])
+}
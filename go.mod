@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	github.com/bazelbuild/bazel-watcher v0.14.0
+	github.com/golang/protobuf v1.4.3
 	golang.org/x/tools v0.0.0-20210114065538-d78b04bdf963
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
 )
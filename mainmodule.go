@@ -0,0 +1,169 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// directive is a line from a go.mod or go.work file.
+// Directives inside a block have the verb of the block.
+type directive struct {
+	verb string
+	args []string
+}
+
+// parseDirectives reads the directives from a go.mod or go.work file.
+// It only understands as much of the syntax as the driver needs, so unlike
+// x/mod it doesn't reject versions or directives from newer go releases.
+func parseDirectives(data []byte) []directive {
+	var result []directive
+	block := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case block != "" && fields[0] == ")":
+			block = ""
+		case block != "":
+			result = append(result, directive{block, unquote(fields)})
+		case len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+		default:
+			result = append(result, directive{fields[0], unquote(fields[1:])})
+		}
+	}
+	return result
+}
+
+func unquote(args []string) []string {
+	for i, arg := range args {
+		if s, err := strconv.Unquote(arg); err == nil {
+			args[i] = s
+		}
+	}
+	return args
+}
+
+// readGoMod returns the main module defined by a go.mod file.
+func readGoMod(filename string) (*packages.Module, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m := &packages.Module{
+		Main:  true,
+		Dir:   filepath.Dir(filename),
+		GoMod: filename,
+	}
+	for _, d := range parseDirectives(data) {
+		if len(d.args) == 0 {
+			continue
+		}
+		switch d.verb {
+		case "module":
+			m.Path = d.args[0]
+		case "go":
+			m.GoVersion = d.args[0]
+		}
+	}
+	if m.Path == "" {
+		return nil, fmt.Errorf("%v: no module directive", filename)
+	}
+	return m, nil
+}
+
+// mainModules returns the main modules for the workspace.
+// If there's a go.work in root, the main modules are the ones it uses,
+// otherwise it's the module defined by root/go.mod.
+func mainModules(root string) []*packages.Module {
+	work := filepath.Join(root, "go.work")
+	if data, err := ioutil.ReadFile(work); err == nil {
+		var modules []*packages.Module
+		goVersion := ""
+		for _, d := range parseDirectives(data) {
+			if len(d.args) == 0 {
+				continue
+			}
+			switch d.verb {
+			case "go":
+				goVersion = d.args[0]
+			case "use":
+				dir := d.args[0]
+				if !filepath.IsAbs(dir) {
+					dir = filepath.Join(root, dir)
+				}
+				m, err := readGoMod(filepath.Join(dir, "go.mod"))
+				if err != nil {
+					log.Printf("%v: %v", work, err)
+					continue
+				}
+				modules = append(modules, m)
+			}
+		}
+		if goVersion != "" {
+			// Like the go command, the go version in go.work applies to the whole workspace.
+			for _, m := range modules {
+				m.GoVersion = goVersion
+			}
+		}
+		return modules
+	}
+
+	m, err := readGoMod(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return nil
+	}
+	return []*packages.Module{m}
+}
+
+// addMainModules sets the Module of workspace packages whose import path is
+// in one of the main modules. If more than one module matches, the one with
+// the longest path is used, like the go command does for nested modules.
+func (d *bazelDriver) addMainModules(pkgs []*packages.Package) {
+	modules := mainModules(d.workspaceRoot)
+	if len(modules) == 0 {
+		return
+	}
+	for _, pkg := range pkgs {
+		if !strings.HasPrefix(targetLabel(pkg.ID), "//") || pkg.Module != nil {
+			continue
+		}
+		// The ID of internal test packages is used as the PkgPath.
+		pkgPath := strings.SplitN(pkg.PkgPath, " [", 2)[0]
+		for _, m := range modules {
+			if pkgPath != m.Path && !strings.HasPrefix(pkgPath, m.Path+"/") {
+				continue
+			}
+			if pkg.Module == nil || len(m.Path) > len(pkg.Module.Path) {
+				pkg.Module = m
+			}
+		}
+	}
+}
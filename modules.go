@@ -0,0 +1,131 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"golang.org/x/tools/go/packages"
+)
+
+// modulesEnv turns on the Module of packages for NeedModule. The driver
+// protocol of the go/packages version the driver is built with doesn't send
+// the Module of a package, so it's off by default and only useful to programs
+// that call the driver as a library.
+const modulesEnv = "GOPACKAGESDRIVER_MODULES"
+
+// wantModules reports whether the packages of the request need a Module.
+func (d *bazelDriver) wantModules() bool {
+	return d.cfg.Mode&packages.NeedModule != 0 && driver.GetEnv(&d.cfg, modulesEnv, "") == "on"
+}
+
+// goRepositoryQuery finds the go_repository rules declared in the WORKSPACE.
+const goRepositoryQuery = "kind(go_repository, //external:*)"
+
+// goRepository is the module information from a gazelle go_repository rule.
+type goRepository struct {
+	importpath string
+	version    string
+	replace    string
+}
+
+// goRepositories returns the go_repository rules, keyed by repository name.
+// Repositories created by bzlmod extensions aren't in //external, so they aren't found.
+func (d *bazelDriver) goRepositories() map[string]*goRepository {
+	result, err := d.query(goRepositoryQuery)
+	if err != nil {
+		log.Printf("couldn't find go_repository rules: %v", err)
+		return nil
+	}
+	repos := make(map[string]*goRepository)
+	for _, t := range result.GetTarget() {
+		rule := t.GetRule()
+		if rule == nil {
+			continue
+		}
+		repo := &goRepository{}
+		var tag string
+		for _, a := range rule.GetAttribute() {
+			switch a.GetName() {
+			case "importpath":
+				repo.importpath = a.GetStringValue()
+			case "version":
+				repo.version = a.GetStringValue()
+			case "replace":
+				repo.replace = a.GetStringValue()
+			case "tag":
+				tag = a.GetStringValue()
+			}
+		}
+		if repo.version == "" {
+			// Repositories fetched from version control may only have a tag.
+			repo.version = tag
+		}
+		// The rules are named //external:<repository name>.
+		name := rule.GetName()
+		repos[name[strings.LastIndex(name, ":")+1:]] = repo
+	}
+	return repos
+}
+
+// addModules sets the Module of packages from go_repository rules.
+func (d *bazelDriver) addModules(pkgs []*packages.Package) {
+	repos := d.goRepositories()
+	if len(repos) == 0 {
+		return
+	}
+	// The execution root is output_base/execroot/<workspace name>.
+	external := filepath.Join(filepath.Dir(filepath.Dir(d.execRoot)), "external")
+	modules := make(map[string]*packages.Module)
+	for _, pkg := range pkgs {
+		label := targetLabel(pkg.ID)
+		if !strings.HasPrefix(label, "@") {
+			continue
+		}
+		name := repoName(label)
+		if m := modules[name]; m != nil {
+			pkg.Module = m
+			continue
+		}
+		repo := repos[name]
+		if repo == nil || repo.importpath == "" {
+			continue
+		}
+		m := &packages.Module{
+			Path:    repo.importpath,
+			Version: repo.version,
+			Dir:     filepath.Join(external, name),
+		}
+		if repo.replace != "" {
+			m.Replace = &packages.Module{Path: repo.replace, Version: repo.version, Dir: m.Dir}
+			m.Version = ""
+		}
+		modules[name] = m
+		pkg.Module = m
+	}
+}
+
+// repoName returns the name of the external repository of label, without
+// the @ or @@ prefix.
+func repoName(label string) string {
+	name := strings.TrimLeft(label, "@")
+	if i := strings.Index(name, "//"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
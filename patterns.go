@@ -0,0 +1,207 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+)
+
+// isDirPattern reports whether patt is a directory pattern like ./foo,
+// ../bar/... or an absolute path, rather than an import path.
+// Labels also look like absolute paths, so check isLabelPattern first.
+func isDirPattern(patt string) bool {
+	return patt == "." || patt == ".." ||
+		strings.HasPrefix(patt, "./") || strings.HasPrefix(patt, "../") ||
+		filepath.IsAbs(patt)
+}
+
+// dirTargetPattern converts a directory pattern into a bazel target pattern
+// for the go targets in the directory, or in its subtree if it ends in /....
+// Relative directories are relative to the directory the driver runs in.
+// Symlinks are resolved, so a directory reached through a symlink to the
+// workspace is still in it.
+// The bazel package is also returned, with a /... suffix for a subtree.
+func (d *bazelDriver) dirTargetPattern(patt string) (targets, pkg string, err error) {
+	dir := filepath.FromSlash(patt)
+	recursive := false
+	if patt == "..." || strings.HasSuffix(patt, "/...") {
+		recursive = true
+		dir = filepath.FromSlash(strings.TrimSuffix(strings.TrimSuffix(patt, "..."), "/"))
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(d.wd, dir)
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	root := d.workspaceRoot
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("directory %v is outside the bazel workspace %v", dir, d.workspaceRoot)
+	}
+	pkg = "//"
+	if rel != "." {
+		pkg += filepath.ToSlash(rel)
+	}
+	switch {
+	case recursive && pkg == "//":
+		return "//...", "//...", nil
+	case recursive:
+		return pkg + "/...", pkg + "/...", nil
+	default:
+		return pkg + ":all", pkg, nil
+	}
+}
+
+// matchPackageQuery reports whether the package id is in one of the bazel
+// packages matched by a directory or label pattern.
+func (d *bazelDriver) matchPackageQuery(id string) bool {
+	pkg := id
+	if i := strings.LastIndex(id, ":"); i > strings.Index(id, "//") {
+		pkg = id[:i]
+	}
+	for q := range d.packageQueries {
+		if q == pkg {
+			return true
+		}
+		if base := strings.TrimSuffix(q, "/..."); base != q && (pkg == base || strings.HasPrefix(pkg, base+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLabelPattern reports whether patt is a bazel label or target pattern,
+// like //foo:foo, //foo/... or @repo//:bar.
+func isLabelPattern(patt string) bool {
+	return strings.HasPrefix(patt, "//") || strings.HasPrefix(patt, "@")
+}
+
+// labelPattern records which packages are the roots for a label pattern,
+// and returns the query for it.
+// Wildcards like //foo:all and //foo/... make every go target in the
+// matching bazel packages a root; a label only makes its own target a root.
+func (d *bazelDriver) labelPattern(patt string) string {
+	label := normalizeLabel(patt)
+	if strings.HasPrefix(label, "@") && !strings.Contains(label, "//") {
+		// @repo is short for @repo//:repo.
+		label += "//:" + repoName(label)
+	}
+	pkg, name := label, ""
+	if i := strings.LastIndex(label, ":"); i > strings.Index(label, "//") {
+		pkg, name = label[:i], label[i+1:]
+	}
+	switch {
+	case name == "all" || name == "*" || name == "all-targets":
+		d.packageQueries[pkg] = true
+	case name == "" && strings.HasSuffix(pkg, "/..."):
+		d.packageQueries[pkg] = true
+	case name == "":
+		// //foo is short for //foo:foo, and @repo// for @repo//:repo.
+		name = path.Base(label[strings.Index(label, "//")+2:])
+		if name == "." {
+			name = repoName(label)
+		}
+		d.labelQueries[pkg+":"+name] = true
+	default:
+		d.labelQueries[label] = true
+	}
+	return d.goFilter(patt)
+}
+
+// aliasTargets maps the labels of the aliases in result to their actual targets.
+func (d *bazelDriver) aliasTargets(result *blaze_query.QueryResult) map[string]string {
+	aliases := make(map[string]string)
+	for _, t := range result.GetTarget() {
+		rule := t.GetRule()
+		if t.GetType() != blaze_query.Target_RULE || d.kinds.RuleClass(rule.GetRuleClass()) != "alias" {
+			continue
+		}
+		for _, a := range rule.GetAttribute() {
+			if d.kinds.AttrName(rule.GetRuleClass(), a.GetName()) == "actual" {
+				aliases[rule.GetName()] = a.GetStringValue()
+			}
+		}
+	}
+	return aliases
+}
+
+// resolveAliases adds the targets of the aliases in labelQueries, so the
+// packages converted from them are roots too.
+func (d *bazelDriver) resolveAliases(aliases map[string]string) {
+	var labels []string
+	for l := range d.labelQueries {
+		labels = append(labels, l)
+	}
+	for _, l := range labels {
+		for actual, ok := aliases[l]; ok && !d.labelQueries[actual]; actual, ok = aliases[actual] {
+			d.labelQueries[actual] = true
+		}
+	}
+}
+
+// stdPackages returns the standard library packages for the std and cmd
+// patterns. cmd is the go command and the other tools; std is the rest.
+func (d *bazelDriver) stdPackages(patt string) []string {
+	var result []string
+	for pkg := range d.sdk.packages {
+		isCmd := pkg == "cmd" || strings.HasPrefix(pkg, "cmd/")
+		if isCmd == (patt == "cmd") {
+			result = append(result, pkg)
+		}
+	}
+	return result
+}
+
+// importPathRegexp converts an import path pattern into an anchored regular
+// expression. Like the go command, ... matches any string, and a trailing
+// /... also matches the path without it, so example.com/foo/... matches
+// example.com/foo. Other characters match themselves.
+// The result is used both in bazel query and with the regexp package.
+func importPathRegexp(patt string) string {
+	suffix := ""
+	if strings.HasSuffix(patt, "/...") {
+		patt = strings.TrimSuffix(patt, "/...")
+		suffix = "(/.*)?"
+	}
+	parts := strings.Split(patt, "...")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return "^" + strings.Join(parts, ".*") + suffix + "$"
+}
+
+// importPathQuery returns the query for the go targets with an importpath
+// matching patt, in the workspace and its dependencies. Custom kinds can keep
+// the importpath in another attribute, so there's an attr() for each name.
+func (d *bazelDriver) importPathQuery(patt string) string {
+	var clauses []string
+	for _, attr := range d.kinds.AttrNames("importpath") {
+		clauses = append(clauses, fmt.Sprintf("attr(%v, '%v', deps(%v))", attr, importPathRegexp(patt), d.goFilter("//...")))
+	}
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	return "(" + strings.Join(clauses, " + ") + ")"
+}
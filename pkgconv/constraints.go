@@ -0,0 +1,143 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkgconv
+
+import (
+	"bytes"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"golang.org/x/tools/go/packages"
+)
+
+// BuildContext returns the context used to evaluate build constraints for cfg.
+// GOOS, GOARCH and CGO_ENABLED are taken from cfg.Env, and the build tags from
+// -tags in cfg.BuildFlags. Files are read through cfg.Overlay.
+func BuildContext(cfg *driver.Request) *build.Context {
+	ctxt := build.Default
+	ctxt.GOOS = driver.GetEnv(cfg, "GOOS", build.Default.GOOS)
+	ctxt.GOARCH = driver.GetEnv(cfg, "GOARCH", build.Default.GOARCH)
+	switch driver.GetEnv(cfg, "CGO_ENABLED", "") {
+	case "0":
+		ctxt.CgoEnabled = false
+	case "1":
+		ctxt.CgoEnabled = true
+	default:
+		// Like the go command, cgo is disabled by default when cross compiling.
+		ctxt.CgoEnabled = build.Default.CgoEnabled && ctxt.GOOS == build.Default.GOOS && ctxt.GOARCH == build.Default.GOARCH
+	}
+	ctxt.BuildTags = buildTags(cfg.BuildFlags)
+	ctxt.OpenFile = func(path string) (io.ReadCloser, error) {
+		src, err := driver.ReadFile(cfg, path)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(src)), nil
+	}
+	return &ctxt
+}
+
+// buildTags returns the tags set by -tags in flags.
+// The tags may be separated by commas or spaces.
+func buildTags(flags []string) []string {
+	var tags []string
+	for i := 0; i < len(flags); i++ {
+		flag := strings.TrimPrefix(flags[i], "-")
+		var value string
+		if strings.HasPrefix(flag, "-tags=") || strings.HasPrefix(flag, "tags=") {
+			value = flag[strings.Index(flag, "=")+1:]
+		} else if (flag == "-tags" || flag == "tags") && i+1 < len(flags) {
+			i++
+			value = flags[i]
+		} else {
+			continue
+		}
+		// Like the go command, the last -tags flag wins.
+		tags = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	return tags
+}
+
+// FilterFiles moves the GoFiles of pkg that are excluded by build constraints
+// in ctxt to IgnoredFiles, and removes them from CompiledGoFiles.
+// Files that can't be read, such as generated files that haven't been built
+// yet, are kept.
+func FilterFiles(ctxt *build.Context, pkg *packages.Package) {
+	ignored := make(map[string]bool)
+	var goFiles []string
+	for _, f := range pkg.GoFiles {
+		if MatchFile(ctxt, f) {
+			goFiles = append(goFiles, f)
+		} else {
+			ignored[f] = true
+			pkg.IgnoredFiles = append(pkg.IgnoredFiles, f)
+		}
+	}
+	if len(ignored) == 0 {
+		return
+	}
+	pkg.GoFiles = goFiles
+	var compiled []string
+	for _, f := range pkg.CompiledGoFiles {
+		if !ignored[f] {
+			compiled = append(compiled, f)
+		}
+	}
+	pkg.CompiledGoFiles = compiled
+}
+
+// MatchFile reports whether filename satisfies the build constraints in ctxt.
+// This checks the _GOOS and _GOARCH suffixes and the +build and go:build lines.
+func MatchFile(ctxt *build.Context, filename string) bool {
+	dir, name := filepath.Split(filename)
+	if strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".") {
+		// go/build always ignores these, but rules_go compiles them.
+		return true
+	}
+	match, err := ctxt.MatchFile(dir, name)
+	if err != nil {
+		return true
+	}
+	if match && !ctxt.CgoEnabled {
+		// Like go/build.Import, files that import "C" are excluded when cgo is disabled.
+		return !fileImportsC(ctxt, filename)
+	}
+	return match
+}
+
+// fileImportsC reports whether filename has an import "C" declaration.
+func fileImportsC(ctxt *build.Context, filename string) bool {
+	r, err := ctxt.OpenFile(filename)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	f, err := parser.ParseFile(token.NewFileSet(), filename, r, parser.ImportsOnly)
+	if err != nil {
+		return false
+	}
+	for _, i := range f.Imports {
+		if i.Path.Value == `"C"` {
+			return true
+		}
+	}
+	return false
+}
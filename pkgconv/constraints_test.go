@@ -0,0 +1,99 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkgconv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"golang.org/x/tools/go/packages"
+)
+
+func TestBuildTags(t *testing.T) {
+	tests := []struct {
+		flags []string
+		want  []string
+	}{
+		{nil, nil},
+		{[]string{"-tags=foo,bar"}, []string{"foo", "bar"}},
+		{[]string{"--tags", "foo bar"}, []string{"foo", "bar"}},
+		{[]string{"-tags=foo", "-v", "-tags=bar"}, []string{"bar"}},
+		{[]string{"-tags"}, nil},
+	}
+	for _, tc := range tests {
+		if got := buildTags(tc.flags); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("buildTags(%q) = %q, want %q", tc.flags, got, tc.want)
+		}
+	}
+}
+
+func TestFilterFiles(t *testing.T) {
+	overlay := map[string][]byte{
+		"/ws/foo/foo.go":         []byte("package foo\n"),
+		"/ws/foo/foo_linux.go":   []byte("package foo\n"),
+		"/ws/foo/foo_windows.go": []byte("package foo\n"),
+		"/ws/foo/tagged.go":      []byte("//go:build special\n\npackage foo\n"),
+		"/ws/foo/cgo.go":         []byte("package foo\n\nimport \"C\"\n"),
+	}
+	goFiles := []string{
+		"/ws/foo/foo.go",
+		"/ws/foo/foo_linux.go",
+		"/ws/foo/foo_windows.go",
+		"/ws/foo/tagged.go",
+		"/ws/foo/cgo.go",
+		"/ws/foo/missing.go",
+	}
+	tests := []struct {
+		name        string
+		env         []string
+		flags       []string
+		wantGo      []string
+		wantIgnored []string
+	}{
+		{
+			name:        "linux",
+			env:         []string{"GOOS=linux", "GOARCH=amd64", "CGO_ENABLED=1"},
+			wantGo:      []string{"/ws/foo/foo.go", "/ws/foo/foo_linux.go", "/ws/foo/cgo.go", "/ws/foo/missing.go"},
+			wantIgnored: []string{"/ws/foo/foo_windows.go", "/ws/foo/tagged.go"},
+		},
+		{
+			name:        "windows with tags",
+			env:         []string{"GOOS=windows", "GOARCH=amd64", "CGO_ENABLED=0"},
+			flags:       []string{"-tags=special"},
+			wantGo:      []string{"/ws/foo/foo.go", "/ws/foo/foo_windows.go", "/ws/foo/tagged.go", "/ws/foo/missing.go"},
+			wantIgnored: []string{"/ws/foo/foo_linux.go", "/ws/foo/cgo.go"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &driver.Request{Env: tc.env, BuildFlags: tc.flags, Overlay: overlay}
+			pkg := &packages.Package{
+				GoFiles:         append([]string(nil), goFiles...),
+				CompiledGoFiles: append([]string(nil), goFiles...),
+			}
+			FilterFiles(BuildContext(cfg), pkg)
+			if !reflect.DeepEqual(pkg.GoFiles, tc.wantGo) {
+				t.Errorf("GoFiles = %v, want %v", pkg.GoFiles, tc.wantGo)
+			}
+			if !reflect.DeepEqual(pkg.CompiledGoFiles, tc.wantGo) {
+				t.Errorf("CompiledGoFiles = %v, want %v", pkg.CompiledGoFiles, tc.wantGo)
+			}
+			if !reflect.DeepEqual(pkg.IgnoredFiles, tc.wantIgnored) {
+				t.Errorf("IgnoredFiles = %v, want %v", pkg.IgnoredFiles, tc.wantIgnored)
+			}
+		})
+	}
+}
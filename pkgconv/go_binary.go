@@ -0,0 +1,98 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkgconv
+
+import (
+	"path"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// convertGoBinary converts a go_binary with its own srcs, or that embeds a
+// go_source, into a main package. A go_binary that only embeds a go_library
+// is skipped, since the library is already converted into the same package.
+// Embedded go_source targets aren't converted on their own, so the binary is
+// the only package with their files.
+func convertGoBinary(t target, g *graph) []*packages.Package {
+	if len(t.srcs) == 0 && !g.embedsSource(t) {
+		return nil
+	}
+	if t.importpath == "" {
+		t.importpath = g.embeddedImportpath(t)
+	}
+	if t.importpath == "" {
+		t.importpath = inferImportpath(t.name)
+	}
+	return convertGoLibrary(t, g)
+}
+
+// embeddedImportpath returns the importpath of the first library that t
+// embeds with an explicit importpath, which rules_go uses for the binary.
+func (g *graph) embeddedImportpath(t target) string {
+	for _, e := range t.embed {
+		if et := g.targets[e]; et != nil {
+			if et.importpath != "" {
+				return et.importpath
+			}
+			if importpath := g.embeddedImportpath(*et); importpath != "" {
+				return importpath
+			}
+		}
+	}
+	return ""
+}
+
+// embedsSource reports whether t embeds a go_source.
+func (g *graph) embedsSource(t target) bool {
+	for _, e := range t.embed {
+		if et := g.targets[e]; et != nil && et.rule == "go_source" {
+			return true
+		}
+	}
+	return false
+}
+
+// convertGoSource converts a go_source into a package.
+// go_source targets are usually embedded into a library, and Load only
+// converts them on their own if nothing in the graph embeds them.
+func convertGoSource(t target, g *graph) []*packages.Package {
+	if t.importpath == "" {
+		t.importpath = inferImportpath(t.name)
+	}
+	return convertGoLibrary(t, g)
+}
+
+// embedded reports whether any target in the graph embeds name.
+func (g *graph) embedded(name string) bool {
+	for _, t := range g.targets {
+		for _, e := range t.embed {
+			if e == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inferImportpath returns the importpath rules_go uses for a target without one:
+// the package of the label, followed by the target name if it's different.
+func inferImportpath(label string) string {
+	_, pkg, name := splitLabel(label)
+	if name != "go_default_library" && !strings.HasSuffix(pkg, name) {
+		return path.Join(pkg, name)
+	}
+	return pkg
+}
@@ -16,11 +16,12 @@ package pkgconv
 
 import (
 	"path/filepath"
-	"strings"
 )
 
-func embedDataPath(t target) string {
-	parts := strings.SplitN(t.name, ":", 2)
-	dir := binpath(parts[0])
-	return filepath.Join(dir, parts[1]+".go")
+func embedDataPath(t target, g *graph) string {
+	if files := g.generated[t.name]; len(files) > 0 {
+		return files[0]
+	}
+	_, _, name := splitLabel(t.name)
+	return filepath.Join(binpath(t.name), name+".go")
 }
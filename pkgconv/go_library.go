@@ -22,7 +22,7 @@ import (
 	"golang.org/x/tools/go/packages"
 )
 
-func convertGoLibrary(t target, targets map[string]*target) []*packages.Package {
+func convertGoLibrary(t target, g *graph) []*packages.Package {
 	if t.importpath == "" {
 		log.Printf("no importpath for %v\n", t.name)
 		return nil
@@ -34,13 +34,13 @@ func convertGoLibrary(t target, targets map[string]*target) []*packages.Package
 		Imports: make(map[string]*packages.Package),
 	}
 
-	processGoSrcs(t, targets, pkg)
-	processDeps(t, targets, pkg)
+	processGoSrcs(t, g, pkg)
+	processDeps(t, g, pkg)
 
 	// add in any embeds
 	for _, e := range t.embed {
-		if et := targets[e]; et != nil {
-			if epkg := et.toPackage(targets); epkg != nil {
+		if et := g.targets[e]; et != nil {
+			if epkg := et.toPackage(g); epkg != nil {
 				pkg.GoFiles = append(pkg.GoFiles, epkg[0].GoFiles...)
 				pkg.OtherFiles = append(pkg.OtherFiles, epkg[0].OtherFiles...)
 				for k, v := range epkg[0].Imports {
@@ -59,15 +59,19 @@ func convertGoLibrary(t target, targets map[string]*target) []*packages.Package
 		return nil
 	}
 
+	if t.cgo {
+		processCgo(t, g, pkg)
+	}
+
 	return []*packages.Package{pkg}
 }
 
-func srcPath(t target, targets map[string]*target, src string) string {
+func srcPath(t target, g *graph, src string) string {
 	packagePrefix := t.name[:strings.Index(t.name, ":")+1]
-	if generator, defined := targets[src]; defined {
+	if generator, defined := g.targets[src]; defined {
 		switch generator.rule {
 		case "go_embed_data":
-			return embedDataPath(*generator)
+			return embedDataPath(*generator, g)
 		default:
 			log.Printf("Unhandled %v in srcs of %v: %v\n", generator.rule, t.name, generator.name)
 			return ""
@@ -80,9 +84,9 @@ func srcPath(t target, targets map[string]*target, src string) string {
 	}
 }
 
-func processGoSrcs(t target, targets map[string]*target, pkg *packages.Package) {
+func processGoSrcs(t target, g *graph, pkg *packages.Package) {
 	for _, src := range t.srcs {
-		path := srcPath(t, targets, src)
+		path := srcPath(t, g, src)
 		if path != "" {
 			switch filepath.Ext(path) {
 			case ".go":
@@ -94,16 +98,49 @@ func processGoSrcs(t target, targets map[string]*target, pkg *packages.Package)
 	}
 }
 
-func processDeps(t target, targets map[string]*target, pkg *packages.Package) {
+func processDeps(t target, g *graph, pkg *packages.Package) {
 	for _, depname := range t.deps {
-		dep := targets[depname]
+		dep := g.targets[depname]
 		for dep != nil && dep.rule == "alias" {
-			dep = targets[dep.actual]
+			dep = g.targets[dep.actual]
 		}
 		if dep != nil && (dep.rule == "go_library" || dep.rule == "go_proto_library") {
 			pkg.Imports[dep.importpath] = &packages.Package{ID: dep.name}
+		} else if dep != nil && registered[dep.rule] != nil && g.registeredPkgPath(dep) != "" {
+			pkg.Imports[g.registeredPkgPath(dep)] = &packages.Package{ID: dep.name}
 		} else {
 			log.Printf("%s: Unhandled dep %s", t.name, depname)
 		}
 	}
 }
+
+// processCgo sets CompiledGoFiles to the go files that are passed to the
+// compiler: the files that don't import "C", and the files generated by cgo.
+// If the cgo outputs aren't known, CompiledGoFiles is left empty and the
+// driver uses GoFiles instead.
+func processCgo(t target, g *graph, pkg *packages.Package) {
+	var generated []string
+	for _, f := range g.generated[t.name] {
+		if filepath.Ext(f) == ".go" {
+			generated = append(generated, f)
+		}
+	}
+	if len(generated) == 0 {
+		log.Printf("no cgo outputs for %v", t.name)
+		return
+	}
+
+	kept := make(map[string]bool)
+	for _, f := range pkg.GoFiles {
+		if !fileImportsC(g.ctxt, f) {
+			pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, f)
+			kept[filepath.Base(f)] = true
+		}
+	}
+	for _, f := range generated {
+		// Some versions of rules_go copy the pure go files alongside the cgo outputs.
+		if !kept[filepath.Base(f)] {
+			pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, f)
+		}
+	}
+}
@@ -22,12 +22,12 @@ import (
 	"golang.org/x/tools/go/packages"
 )
 
-func convertGoProtoLibrary(t target, targets map[string]*target) []*packages.Package {
+func convertGoProtoLibrary(t target, g *graph) []*packages.Package {
 	if t.importpath == "" {
 		log.Printf("no importpath for %v\n", t.name)
 		return nil
 	}
-	name := strings.SplitN(t.name, ":", 2)[1]
+	_, _, name := splitLabel(t.name)
 	path := filepath.Join(binpath(t.name), name+"_", t.importpath)
 
 	pkg := &packages.Package{
@@ -37,20 +37,24 @@ func convertGoProtoLibrary(t target, targets map[string]*target) []*packages.Pac
 	}
 	packagePrefix := t.name[:strings.Index(t.name, ":")+1]
 
+	// Prefer the outputs reported by bazel over guessing the compiler output names.
+	generated, haveGenerated := g.generated[t.name]
+	pkg.GoFiles = append(pkg.GoFiles, generated...)
+
 	for _, proto := range t.srcs {
-		for _, src := range protoSrcs(targets, proto) {
+		for _, src := range protoSrcs(g, proto) {
 			basename := strings.TrimSuffix(filepath.Base(strings.TrimPrefix(src, packagePrefix)), ".proto")
 			for _, cname := range t.compilers {
-				if compiler := targets[cname]; compiler == nil {
+				if compiler := g.targets[cname]; compiler == nil {
 					log.Printf("Unknown compiler %v\n", cname)
 					continue
 				} else if compiler.rule == "go_proto_wrapper" {
-					if len(compiler.embed) == 0 || targets[compiler.embed[0]] == nil {
+					if len(compiler.embed) == 0 || g.targets[compiler.embed[0]] == nil {
 						log.Printf("invalid go_proto_wrapper %v", compiler.name)
 						continue
 					}
-					lib := targets[compiler.embed[0]]
-					libp := lib.toPackage(targets)
+					lib := g.targets[compiler.embed[0]]
+					libp := lib.toPackage(g)
 					if len(libp) == 0 {
 						log.Printf("not found")
 						continue
@@ -60,31 +64,33 @@ func convertGoProtoLibrary(t target, targets map[string]*target) []*packages.Pac
 						pkg.Imports[k] = v
 					}
 				} else {
-					pkg.GoFiles = append(pkg.GoFiles, filepath.Join(path, basename+compiler.suffix))
+					if !haveGenerated {
+						pkg.GoFiles = append(pkg.GoFiles, filepath.Join(path, basename+compiler.suffix))
+					}
 					t.deps = append(t.deps, compiler.deps...)
 				}
 			}
 		}
 	}
 
-	processDeps(t, targets, pkg)
+	processDeps(t, g, pkg)
 
 	return []*packages.Package{pkg}
 }
 
-func protoSrcs(targets map[string]*target, name string) []string {
-	for targets[name] != nil && targets[name].rule == "alias" {
-		log.Printf("%#v -> %#v", name, targets[name].actual)
-		name = targets[name].actual
+func protoSrcs(g *graph, name string) []string {
+	for g.targets[name] != nil && g.targets[name].rule == "alias" {
+		log.Printf("%#v -> %#v", name, g.targets[name].actual)
+		name = g.targets[name].actual
 	}
-	target := targets[name]
+	target := g.targets[name]
 	if target == nil || target.rule != "proto_library" {
 		log.Printf("Unrecognized proto_library  %#v\n", name)
 		return nil
 	}
 	var srcs []string
 	for _, s := range target.srcs {
-		srcs = append(srcs, srcPath(*target, targets, s))
+		srcs = append(srcs, srcPath(*target, g, s))
 	}
 	return srcs
 }
@@ -20,18 +20,22 @@ import (
 	"go/token"
 	"log"
 	"path/filepath"
-	"strings"
 
+	"github.com/derivita/bazelpackagesdriver/driver"
 	"golang.org/x/tools/go/packages"
 )
 
-func testmainPath(t target) string {
-	parts := strings.SplitN(t.name, ":", 2)
-	dir := binpath(parts[0])
-	return filepath.Join(dir, fmt.Sprintf("%s_/testmain.go", parts[1]))
+func testmainPath(t target, g *graph) string {
+	for _, f := range g.generated[t.name] {
+		if filepath.Base(f) == "testmain.go" {
+			return f
+		}
+	}
+	_, _, name := splitLabel(t.name)
+	return filepath.Join(binpath(t.name), fmt.Sprintf("%s_/testmain.go", name))
 }
 
-func convertGoTest(t target, targets map[string]*target) []*packages.Package {
+func convertGoTest(t target, g *graph) []*packages.Package {
 	importPath := t.importpath
 	var packageName string
 
@@ -43,8 +47,8 @@ func convertGoTest(t target, targets map[string]*target) []*packages.Package {
 
 	// First process embedded sources
 	for _, e := range t.embed {
-		if et := targets[e]; et != nil {
-			if epkg := et.toPackage(targets); epkg != nil {
+		if et := g.targets[e]; et != nil {
+			if epkg := et.toPackage(g); epkg != nil {
 				embed.GoFiles = append(embed.GoFiles, epkg[0].GoFiles...)
 				embed.OtherFiles = append(embed.OtherFiles, epkg[0].OtherFiles...)
 				if importPath == "" {
@@ -57,7 +61,7 @@ func convertGoTest(t target, targets map[string]*target) []*packages.Package {
 				}
 				for _, s := range epkg[0].GoFiles {
 					if packageName == "" {
-						packageName = parsePackageName(s)
+						packageName = parsePackageName(g.cfg, s)
 					} else {
 						break
 					}
@@ -74,8 +78,8 @@ func convertGoTest(t target, targets map[string]*target) []*packages.Package {
 		Imports: make(map[string]*packages.Package),
 	}
 
-	processGoSrcs(t, targets, pkg)
-	processDeps(t, targets, pkg)
+	processGoSrcs(t, g, pkg)
+	processDeps(t, g, pkg)
 
 	embed.ID = fmt.Sprintf("%s [%s]", importPath, t.name)
 	embed.PkgPath = embed.ID
@@ -87,7 +91,7 @@ func convertGoTest(t target, targets map[string]*target) []*packages.Package {
 
 	// separate internal and external test files
 	for _, f := range pkg.GoFiles {
-		name := parsePackageName(f)
+		name := parsePackageName(g.cfg, f)
 		if name == packageName || name == "" {
 			embed.GoFiles = append(embed.GoFiles, f)
 		} else {
@@ -105,7 +109,7 @@ func convertGoTest(t target, targets map[string]*target) []*packages.Package {
 		}
 	}
 	pkg.Name = "main"
-	pkg.GoFiles = []string{testmainPath(t)}
+	pkg.GoFiles = []string{testmainPath(t, g)}
 	pkg.Imports = make(map[string]*packages.Package, len(extPackages)+1)
 
 	pkgs := make([]*packages.Package, 0, len(extPackages)+2)
@@ -122,9 +126,13 @@ func convertGoTest(t target, targets map[string]*target) []*packages.Package {
 	return pkgs
 }
 
-func parsePackageName(filename string) string {
+func parsePackageName(cfg *driver.Request, filename string) string {
+	src, err := driver.ReadFile(cfg, filename)
+	if err != nil {
+		return ""
+	}
 	fset := token.NewFileSet()
-	if f, err := parser.ParseFile(fset, filename, nil, parser.PackageClauseOnly); err == nil {
+	if f, err := parser.ParseFile(fset, filename, src, parser.PackageClauseOnly); err == nil {
 		return f.Name.Name
 	}
 	return ""
@@ -0,0 +1,126 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkgconv
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RuleKind describes a custom rule or macro that's converted like one of the
+// rules_go rules, for example a company_go_library rule that wraps go_library.
+type RuleKind struct {
+	// Like is the behavior of the rule: "library", "proto", "test" or "binary".
+	Like string `json:"like"`
+	// Attrs maps the rules_go attribute names, like srcs, deps and importpath,
+	// to the names of the attributes that hold them in the custom rule.
+	// Attributes that aren't in Attrs use the rules_go name.
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+// RuleKinds maps the rule classes of custom rules to how they're converted.
+type RuleKinds map[string]RuleKind
+
+// likeRules are the rules_go rules that custom rules can behave like.
+var likeRules = map[string]string{
+	"library": "go_library",
+	"proto":   "go_proto_library",
+	"test":    "go_test",
+	"binary":  "go_binary",
+}
+
+// Validate checks that each kind has a known behavior, and that Attrs doesn't
+// use the same attribute of the custom rule for more than one rules_go attribute.
+func (k RuleKinds) Validate() error {
+	for _, class := range k.Classes() {
+		kind := k[class]
+		if likeRules[kind.Like] == "" {
+			return fmt.Errorf("rule kind %v: unknown behavior %#v", class, kind.Like)
+		}
+		names := make(map[string]string, len(kind.Attrs))
+		for _, name := range kind.attrKeys() {
+			custom := kind.Attrs[name]
+			if other, ok := names[custom]; ok {
+				return fmt.Errorf("rule kind %v: attribute %v is used for both %v and %v", class, custom, other, name)
+			}
+			names[custom] = name
+		}
+	}
+	return nil
+}
+
+// attrKeys returns the rules_go attribute names in Attrs, in sorted order.
+func (kind RuleKind) attrKeys() []string {
+	var names []string
+	for name := range kind.Attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Classes returns the rule classes in k, in sorted order.
+func (k RuleKinds) Classes() []string {
+	var classes []string
+	for class := range k {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// RuleClass returns the rules_go rule class that class is converted as.
+func (k RuleKinds) RuleClass(class string) string {
+	if kind, ok := k[class]; ok {
+		if rule := likeRules[kind.Like]; rule != "" {
+			return rule
+		}
+	}
+	return class
+}
+
+// AttrName returns the rules_go name for the attribute attr of a rule.
+// It returns "" for attributes of custom rules that are hidden by Attrs,
+// so a custom rule's own srcs isn't used if Attrs renames srcs.
+func (k RuleKinds) AttrName(class, attr string) string {
+	kind, ok := k[class]
+	if !ok {
+		return attr
+	}
+	for _, name := range kind.attrKeys() {
+		if kind.Attrs[name] == attr {
+			return name
+		}
+	}
+	if _, renamed := kind.Attrs[attr]; renamed {
+		return ""
+	}
+	return attr
+}
+
+// AttrNames returns the names of the attributes that hold the rules_go
+// attribute attr in the rules_go rules and the custom rules, in sorted order.
+func (k RuleKinds) AttrNames(attr string) []string {
+	names := []string{attr}
+	seen := map[string]bool{attr: true}
+	for _, kind := range k {
+		if name := kind.Attrs[attr]; name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkgconv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"golang.org/x/tools/go/packages"
+)
+
+func TestLoadCustomKinds(t *testing.T) {
+	kinds := RuleKinds{
+		"company_go_library": {
+			Like:  "library",
+			Attrs: map[string]string{"srcs": "go_srcs", "importpath": "import_path"},
+		},
+	}
+	targets := []*blaze_query.Target{
+		barLibrary,
+		rule("company_go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:19",
+			stringAttr("import_path", "example.com/foo"),
+			listAttr("go_srcs", "//foo:foo.go"),
+			listAttr("srcs", "//foo:foo.ts"),
+			listAttr("deps", "//bar:bar"),
+		),
+	}
+	cfg := &driver.Request{Overlay: map[string][]byte{"/ws/foo/foo.go": []byte("package foo\n")}}
+	got := byID(Load(cfg, targets, nil, kinds))
+	want := byID([]*packages.Package{
+		{
+			ID:      "//bar:bar",
+			PkgPath: "example.com/bar",
+			GoFiles: []string{"/ws/bar/bar.go"},
+			Imports: imports(nil),
+		},
+		{
+			ID:      "//foo:foo",
+			PkgPath: "example.com/foo",
+			GoFiles: []string{"/ws/foo/foo.go"},
+			Imports: imports(map[string]string{"example.com/bar": "//bar:bar"}),
+		},
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() =\n%v\nwant\n%v", dump(got), dump(want))
+	}
+}
+
+func TestRuleKinds(t *testing.T) {
+	kinds := RuleKinds{
+		"company_go_test":  {Like: "test", Attrs: map[string]string{"srcs": "go_srcs"}},
+		"buf_go_generator": {Like: "proto"},
+	}
+	if err := kinds.Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (RuleKinds{"x": {Like: "macro"}}).Validate(); err == nil {
+		t.Error("Validate() accepted an unknown behavior")
+	}
+	if err := (RuleKinds{"x": {Like: "library", Attrs: map[string]string{"srcs": "go_srcs", "embed": "go_srcs"}}}).Validate(); err == nil {
+		t.Error("Validate() accepted an attribute used for both srcs and embed")
+	}
+	if got, want := kinds.Classes(), []string{"buf_go_generator", "company_go_test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Classes() = %v, want %v", got, want)
+	}
+	targets := []*blaze_query.Target{
+		rule("company_go_test", "//foo:foo_test", "/ws/foo/BUILD.bazel:1:16"),
+		rule("buf_go_generator", "//foo:foo_buf", "/ws/foo/BUILD.bazel:9:17"),
+		rule("company_go_other", "//foo:other", "/ws/foo/BUILD.bazel:15:17"),
+	}
+	if got, want := Generators(targets, kinds), []string{"//foo:foo_test", "//foo:foo_buf"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Generators() = %v, want %v", got, want)
+	}
+	if got, want := kinds.RuleClass("company_go_test"), "go_test"; got != want {
+		t.Errorf("RuleClass(company_go_test) = %v, want %v", got, want)
+	}
+	if got, want := kinds.RuleClass("go_library"), "go_library"; got != want {
+		t.Errorf("RuleClass(go_library) = %v, want %v", got, want)
+	}
+	if got, want := kinds.AttrNames("srcs"), []string{"go_srcs", "srcs"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AttrNames(srcs) = %v, want %v", got, want)
+	}
+	if got, want := kinds.AttrNames("importpath"), []string{"importpath"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AttrNames(importpath) = %v, want %v", got, want)
+	}
+	attrs := map[string]string{"go_srcs": "srcs", "srcs": "", "deps": "deps"}
+	for attr, want := range attrs {
+		if got := kinds.AttrName("company_go_test", attr); got != want {
+			t.Errorf("AttrName(%v) = %#v, want %#v", attr, got, want)
+		}
+	}
+}
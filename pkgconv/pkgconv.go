@@ -16,11 +16,14 @@ package pkgconv
 
 import (
 	"fmt"
+	"go/build"
 	"log"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/derivita/bazelpackagesdriver/driver"
 	"golang.org/x/tools/go/packages"
 )
 
@@ -35,17 +38,84 @@ type target struct {
 	suffix     string
 	compilers  []string
 	actual     string
+	cgo        bool
+	attrs      []*blaze_query.Attribute
+}
+
+// graph holds the targets from a query, along with the driver request that
+// the packages are being loaded for.
+type graph struct {
+	cfg       *driver.Request
+	ctxt      *build.Context
+	targets   map[string]*target
+	generated GeneratedFiles
+	sel       *selector
+	converted map[string][]*packages.Package
+}
+
+// GeneratedFiles maps a target label to the go files written by that target's actions.
+type GeneratedFiles map[string][]string
+
+// generatorRules are the rules whose outputs are used as go sources.
+var generatorRules = map[string]bool{
+	"go_embed_data":    true,
+	"go_proto_library": true,
+	"go_test":          true,
+}
+
+// Generators returns the labels of the targets that generate go sources.
+// This includes go_library targets with cgo = True, since the files that
+// import "C" are compiled from the output of cgo, custom rules in kinds
+// that behave like one of the generator rules, and rule classes registered
+// with the GeneratesSources option.
+// The driver should find their outputs and pass them to Load.
+func Generators(protoTargets []*blaze_query.Target, kinds RuleKinds) []string {
+	var labels []string
+	for _, pt := range protoTargets {
+		if pt.GetType() != blaze_query.Target_RULE {
+			continue
+		}
+		rule := pt.GetRule()
+		class := kinds.RuleClass(rule.GetRuleClass())
+		if generatorRules[class] || (registered[class] != nil && registered[class].generatesSources) || usesCgo(rule) {
+			labels = append(labels, rule.GetName())
+		}
+	}
+	return labels
+}
+
+// usesCgo reports whether rule sets cgo = True. The platform isn't known
+// here, so a select() uses cgo if any of its branches do.
+func usesCgo(rule *blaze_query.Rule) bool {
+	for _, a := range rule.GetAttribute() {
+		if a.GetName() == "cgo" {
+			return (&selector{policy: SelectUnion}).boolValue(a)
+		}
+	}
+	return false
 }
 
 // Load generates packages.Packages from bazel query results.
 // Each go rule in the input is converted into a Package with ID, PkgPath, and Imports.
 // Imports is generated from bazel deps, so it does not include any standard library packages.
 // Name may also be set for test packages.
-func Load(protoTargets []*blaze_query.Target) []*packages.Package {
+// Source files are read through cfg.Overlay when the package clause is needed.
+// Attributes that use select() are resolved with the policy set by SelectEnv.
+// The paths of generated files are taken from generated. If a target is missing
+// from generated, its outputs are assumed to be in the default bazel-bin location.
+// Rules with a class in kinds are converted like the rules_go rule they behave like.
+func Load(cfg *driver.Request, protoTargets []*blaze_query.Target, generated GeneratedFiles, kinds RuleKinds) []*packages.Package {
 	var pkgs []*packages.Package
 
-	targets := make(map[string]*target)
+	g := &graph{
+		cfg:       cfg,
+		ctxt:      BuildContext(cfg),
+		targets:   make(map[string]*target),
+		generated: generated,
+	}
 
+	g.sel = newSelector(cfg, g.ctxt.GOOS, g.ctxt.GOARCH)
+	sel := g.sel
 	for _, pt := range protoTargets {
 		if pt.GetType() != blaze_query.Target_RULE {
 			continue
@@ -53,62 +123,67 @@ func Load(protoTargets []*blaze_query.Target) []*packages.Package {
 		rule := pt.GetRule()
 		t := &target{
 			name:   rule.GetName(),
-			rule:   rule.GetRuleClass(),
+			rule:   kinds.RuleClass(rule.GetRuleClass()),
 			folder: filepath.Dir(rule.GetLocation()),
+			attrs:  rule.GetAttribute(),
 		}
 		for _, a := range rule.GetAttribute() {
-			switch a.GetName() {
+			switch kinds.AttrName(rule.GetRuleClass(), a.GetName()) {
 			case "deps":
-				t.deps = a.GetStringListValue()
+				t.deps = sel.stringList(a)
 			case "srcs":
-				t.srcs = a.GetStringListValue()
+				t.srcs = sel.stringList(a)
 			case "embed":
-				t.embed = a.GetStringListValue()
+				t.embed = sel.stringList(a)
 			case "importpath":
-				t.importpath = a.GetStringValue()
+				t.importpath = sel.stringValue(a)
 			case "suffix":
-				t.suffix = a.GetStringValue()
+				t.suffix = sel.stringValue(a)
 			case "proto":
-				proto := a.GetStringValue()
+				proto := sel.stringValue(a)
 				if proto != "" {
 					t.srcs = append(t.srcs, proto)
 				}
 			case "protos":
-				t.srcs = append(t.srcs, a.GetStringListValue()...)
+				t.srcs = append(t.srcs, sel.stringList(a)...)
 			case "compilers":
-				t.compilers = a.GetStringListValue()
+				t.compilers = sel.stringList(a)
 			case "actual":
-				t.actual = a.GetStringValue()
+				t.actual = sel.stringValue(a)
 			case "library":
-				t.embed = []string{a.GetStringValue()}
+				t.embed = []string{sel.stringValue(a)}
+			case "cgo":
+				t.cgo = sel.boolValue(a)
 			}
 		}
-		targets[t.name] = t
+		g.targets[t.name] = t
 	}
 
-	for _, t := range targets {
-		pkg := t.toPackage(targets)
+	for _, t := range g.targets {
+		if t.rule == "go_source" && g.embedded(t.name) {
+			// The sources are part of the package that embeds them.
+			continue
+		}
+		pkg := t.toPackage(g)
 		pkgs = append(pkgs, pkg...)
 	}
 
 	return pkgs
 }
 
-func (t target) toPackage(targets map[string]*target) []*packages.Package {
+func (t target) toPackage(g *graph) []*packages.Package {
+	if r := registered[t.rule]; r != nil {
+		return g.convertRegistered(t, r.convert)
+	}
+	if convert := builtinConverter(t.rule); convert != nil {
+		return convert(t, g)
+	}
 	switch t.rule {
-	case "go_library":
-		return convertGoLibrary(t, targets)
-	case "go_proto_library":
-		return convertGoProtoLibrary(t, targets)
 	case "go_tool_library":
 		// ignore
-	case "go_test":
-		return convertGoTest(t, targets)
 	case "alias":
-		actual := targets[t.actual]
-		if actual != nil {
-			return actual.toPackage(targets)
-		}
+		// The actual target is converted on its own, and deps on the
+		// alias are resolved to it.
 	default:
 		if t.importpath != "" {
 			log.Printf("importpath %#v for %v %v", t.importpath, t.rule, t.name)
@@ -117,18 +192,37 @@ func (t target) toPackage(targets map[string]*target) []*packages.Package {
 	return nil
 }
 
-func binpath(pkg string) string {
-	if index := strings.Index(pkg, ":"); index != -1 {
-		pkg = pkg[:index]
-	}
-	if pkg[0] == '@' {
-		parts := strings.Split(pkg[1:], "//")
-		return filepath.Join("bazel-bin", "external", parts[0], parts[1])
+// binpath returns the bazel-bin directory for the package of label.
+func binpath(label string) string {
+	repo, pkg, _ := splitLabel(label)
+	if repo != "" {
+		return filepath.Join("bazel-bin", "external", repo, pkg)
 	}
-	pkg = strings.TrimPrefix(pkg, "//")
 	return filepath.Join("bazel-bin", pkg)
 }
 
+// splitLabel returns the repository, package and name of label.
+// The repository is empty for the main repository. Both apparent (@repo) and
+// canonical (@@repo) names are accepted; bazel query reports the canonical name
+// for external repositories when bzlmod is enabled, which is also the name of
+// the directory in external.
+func splitLabel(label string) (repo, pkg, name string) {
+	if strings.HasPrefix(label, "@") {
+		label = strings.TrimLeft(label, "@")
+		i := strings.Index(label, "//")
+		if i < 0 {
+			// @repo is short for @repo//:repo.
+			return label, "", label
+		}
+		repo, label = label[:i], label[i:]
+	}
+	label = strings.TrimPrefix(label, "//")
+	if i := strings.Index(label, ":"); i >= 0 {
+		return repo, label[:i], label[i+1:]
+	}
+	return repo, label, path.Base(label)
+}
+
 func targetName(t *blaze_query.Target) string {
 	switch t.GetType() {
 	case blaze_query.Target_RULE:
@@ -0,0 +1,566 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkgconv
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/tools/go/packages"
+)
+
+func rule(class, name, location string, attrs ...*blaze_query.Attribute) *blaze_query.Target {
+	return &blaze_query.Target{
+		Type: blaze_query.Target_RULE.Enum(),
+		Rule: &blaze_query.Rule{
+			Name:      proto.String(name),
+			RuleClass: proto.String(class),
+			Location:  proto.String(location),
+			Attribute: attrs,
+		},
+	}
+}
+
+func stringAttr(name, value string) *blaze_query.Attribute {
+	return &blaze_query.Attribute{
+		Name:        proto.String(name),
+		Type:        blaze_query.Attribute_STRING.Enum(),
+		StringValue: proto.String(value),
+	}
+}
+
+func labelAttr(name, value string) *blaze_query.Attribute {
+	return &blaze_query.Attribute{
+		Name:        proto.String(name),
+		Type:        blaze_query.Attribute_LABEL.Enum(),
+		StringValue: proto.String(value),
+	}
+}
+
+func listAttr(name string, values ...string) *blaze_query.Attribute {
+	return &blaze_query.Attribute{
+		Name:            proto.String(name),
+		Type:            blaze_query.Attribute_LABEL_LIST.Enum(),
+		StringListValue: values,
+	}
+}
+
+func boolAttr(name string, value bool) *blaze_query.Attribute {
+	return &blaze_query.Attribute{
+		Name:         proto.String(name),
+		Type:         blaze_query.Attribute_BOOLEAN.Enum(),
+		BooleanValue: proto.Bool(value),
+	}
+}
+
+// Targets shared by the test cases.
+var (
+	barLibrary = rule("go_library", "//bar:bar", "/ws/bar/BUILD.bazel:1:11",
+		stringAttr("importpath", "example.com/bar"),
+		listAttr("srcs", "//bar:bar.go"),
+	)
+	bazLibrary = rule("go_library", "//baz:baz", "/ws/baz/BUILD.bazel:1:11",
+		stringAttr("importpath", "example.com/baz"),
+		listAttr("srcs", "//baz:baz.go"),
+	)
+	bazAlias = rule("alias", "//baz:alias", "/ws/baz/BUILD.bazel:7:6",
+		labelAttr("actual", "//baz:baz"),
+	)
+	fooLibrary = rule("go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:11",
+		stringAttr("importpath", "example.com/foo"),
+		listAttr("srcs", "//foo:foo.go"),
+		listAttr("deps", "//bar:bar"),
+	)
+	protoRuntime = rule("go_library", "//proto:runtime", "/ws/proto/BUILD.bazel:1:11",
+		stringAttr("importpath", "google.golang.org/protobuf/proto"),
+		listAttr("srcs", "//proto:proto.go"),
+	)
+	protoCompiler = rule("go_proto_compiler", "//proto:go_proto", "/ws/proto/BUILD.bazel:7:18",
+		stringAttr("suffix", ".pb.go"),
+		listAttr("deps", "//proto:runtime"),
+	)
+	fooProto = rule("proto_library", "//foo:foo_proto", "/ws/foo/BUILD.bazel:7:14",
+		listAttr("srcs", "//foo:foo.proto"),
+	)
+	fooGoProto = rule("go_proto_library", "//foo:foo_go_proto", "/ws/foo/BUILD.bazel:12:17",
+		stringAttr("importpath", "example.com/foo"),
+		labelAttr("proto", "//foo:foo_proto"),
+		listAttr("compilers", "//proto:go_proto"),
+	)
+	fooTest = rule("go_test", "//foo:foo_test", "/ws/foo/BUILD.bazel:20:8",
+		listAttr("srcs", "//foo:foo_test.go", "//foo:ext_test.go"),
+		listAttr("embed", "//foo:foo"),
+		listAttr("deps", "//baz:baz"),
+	)
+)
+
+func imports(ids map[string]string) map[string]*packages.Package {
+	result := make(map[string]*packages.Package, len(ids))
+	for path, id := range ids {
+		result[path] = &packages.Package{ID: id}
+	}
+	return result
+}
+
+func TestLoad(t *testing.T) {
+	overlay := map[string][]byte{
+		"/ws/foo/foo.go":      []byte("package foo\n"),
+		"/ws/foo/foo_test.go": []byte("package foo\n"),
+		"/ws/foo/ext_test.go": []byte("package foo_test\n"),
+		"/ws/foo/cgo.go":      []byte("package foo\n\nimport \"C\"\n"),
+	}
+	barPackage := &packages.Package{
+		ID:      "//bar:bar",
+		PkgPath: "example.com/bar",
+		GoFiles: []string{"/ws/bar/bar.go"},
+		Imports: imports(nil),
+	}
+	bazPackage := &packages.Package{
+		ID:      "//baz:baz",
+		PkgPath: "example.com/baz",
+		GoFiles: []string{"/ws/baz/baz.go"},
+		Imports: imports(nil),
+	}
+	protoPackage := &packages.Package{
+		ID:      "//proto:runtime",
+		PkgPath: "google.golang.org/protobuf/proto",
+		GoFiles: []string{"/ws/proto/proto.go"},
+		Imports: imports(nil),
+	}
+
+	tests := []struct {
+		name      string
+		targets   []*blaze_query.Target
+		generated GeneratedFiles
+		want      []*packages.Package
+	}{
+		{
+			name: "go_library",
+			targets: []*blaze_query.Target{
+				rule("go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:11",
+					stringAttr("importpath", "example.com/foo"),
+					listAttr("srcs", "//foo:foo.go", "//foo:foo.h"),
+					listAttr("deps", "//bar:bar", "//baz:alias"),
+				),
+				barLibrary,
+				bazLibrary,
+				bazAlias,
+			},
+			want: []*packages.Package{
+				{
+					ID:         "//foo:foo",
+					PkgPath:    "example.com/foo",
+					GoFiles:    []string{"/ws/foo/foo.go"},
+					OtherFiles: []string{"/ws/foo/foo.h"},
+					Imports:    imports(map[string]string{"example.com/bar": "//bar:bar", "example.com/baz": "//baz:baz"}),
+				},
+				barPackage,
+				bazPackage,
+			},
+		},
+		{
+			name: "no importpath",
+			targets: []*blaze_query.Target{
+				rule("go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:11",
+					listAttr("srcs", "//foo:foo.go"),
+				),
+			},
+		},
+		{
+			name: "embed",
+			targets: []*blaze_query.Target{
+				rule("go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:11",
+					stringAttr("importpath", "example.com/foo"),
+					listAttr("srcs", "//foo:foo.go"),
+					listAttr("embed", "//foo:embedded"),
+				),
+				rule("go_library", "//foo:embedded", "/ws/foo/BUILD.bazel:7:11",
+					stringAttr("importpath", "example.com/foo"),
+					listAttr("srcs", "//foo:embedded.go"),
+					listAttr("deps", "//bar:bar"),
+				),
+				barLibrary,
+			},
+			want: []*packages.Package{
+				{
+					ID:      "//foo:foo",
+					PkgPath: "example.com/foo",
+					GoFiles: []string{"/ws/foo/foo.go", "/ws/foo/embedded.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar"}),
+				},
+				{
+					ID:      "//foo:embedded",
+					PkgPath: "example.com/foo",
+					GoFiles: []string{"/ws/foo/embedded.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar"}),
+				},
+				barPackage,
+			},
+		},
+		{
+			name: "go_embed_data",
+			targets: []*blaze_query.Target{
+				rule("go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:11",
+					stringAttr("importpath", "example.com/foo"),
+					listAttr("srcs", "//foo:foo.go", "//foo:data"),
+				),
+				rule("go_embed_data", "//foo:data", "/ws/foo/BUILD.bazel:7:14"),
+			},
+			want: []*packages.Package{
+				{
+					ID:      "//foo:foo",
+					PkgPath: "example.com/foo",
+					GoFiles: []string{"/ws/foo/foo.go", "bazel-bin/foo/data.go"},
+					Imports: imports(nil),
+				},
+			},
+		},
+		{
+			name: "go_embed_data generated",
+			targets: []*blaze_query.Target{
+				rule("go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:11",
+					stringAttr("importpath", "example.com/foo"),
+					listAttr("srcs", "//foo:foo.go", "//foo:data"),
+				),
+				rule("go_embed_data", "//foo:data", "/ws/foo/BUILD.bazel:7:14"),
+			},
+			generated: GeneratedFiles{"//foo:data": {"/out/foo/data.go"}},
+			want: []*packages.Package{
+				{
+					ID:      "//foo:foo",
+					PkgPath: "example.com/foo",
+					GoFiles: []string{"/ws/foo/foo.go", "/out/foo/data.go"},
+					Imports: imports(nil),
+				},
+			},
+		},
+		{
+			name:    "go_proto_library",
+			targets: []*blaze_query.Target{fooGoProto, fooProto, protoCompiler, protoRuntime},
+			want: []*packages.Package{
+				{
+					ID:      "//foo:foo_go_proto",
+					PkgPath: "example.com/foo",
+					GoFiles: []string{"bazel-bin/foo/foo_go_proto_/example.com/foo/foo.pb.go"},
+					Imports: imports(map[string]string{"google.golang.org/protobuf/proto": "//proto:runtime"}),
+				},
+				protoPackage,
+			},
+		},
+		{
+			name:      "go_proto_library generated",
+			targets:   []*blaze_query.Target{fooGoProto, fooProto, protoCompiler, protoRuntime},
+			generated: GeneratedFiles{"//foo:foo_go_proto": {"/out/foo/foo.pb.go"}},
+			want: []*packages.Package{
+				{
+					ID:      "//foo:foo_go_proto",
+					PkgPath: "example.com/foo",
+					GoFiles: []string{"/out/foo/foo.pb.go"},
+					Imports: imports(map[string]string{"google.golang.org/protobuf/proto": "//proto:runtime"}),
+				},
+				protoPackage,
+			},
+		},
+		{
+			name:    "go_test",
+			targets: []*blaze_query.Target{fooTest, fooLibrary, barLibrary, bazLibrary},
+			want: []*packages.Package{
+				{
+					ID:      "//foo:foo_test",
+					Name:    "main",
+					PkgPath: "example.com/foo.test",
+					GoFiles: []string{"bazel-bin/foo/foo_test_/testmain.go"},
+					Imports: imports(map[string]string{
+						"example.com/foo":      "example.com/foo [//foo:foo_test]",
+						"example.com/foo_test": "example.com/foo_test [//foo:foo_test]",
+					}),
+				},
+				{
+					ID:      "example.com/foo [//foo:foo_test]",
+					PkgPath: "example.com/foo [//foo:foo_test]",
+					GoFiles: []string{"/ws/foo/foo.go", "/ws/foo/foo_test.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar", "example.com/baz": "//baz:baz"}),
+				},
+				{
+					ID:      "example.com/foo_test [//foo:foo_test]",
+					PkgPath: "example.com/foo_test",
+					GoFiles: []string{"/ws/foo/ext_test.go"},
+					Imports: imports(map[string]string{"example.com/baz": "//baz:baz"}),
+				},
+				{
+					ID:      "//foo:foo",
+					PkgPath: "example.com/foo",
+					GoFiles: []string{"/ws/foo/foo.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar"}),
+				},
+				barPackage,
+				bazPackage,
+			},
+		},
+		{
+			name:      "go_test generated testmain",
+			targets:   []*blaze_query.Target{fooTest, fooLibrary, barLibrary, bazLibrary},
+			generated: GeneratedFiles{"//foo:foo_test": {"/out/foo/foo_test_/testmain.go"}},
+			want: []*packages.Package{
+				{
+					ID:      "//foo:foo_test",
+					Name:    "main",
+					PkgPath: "example.com/foo.test",
+					GoFiles: []string{"/out/foo/foo_test_/testmain.go"},
+					Imports: imports(map[string]string{
+						"example.com/foo":      "example.com/foo [//foo:foo_test]",
+						"example.com/foo_test": "example.com/foo_test [//foo:foo_test]",
+					}),
+				},
+				{
+					ID:      "example.com/foo [//foo:foo_test]",
+					PkgPath: "example.com/foo [//foo:foo_test]",
+					GoFiles: []string{"/ws/foo/foo.go", "/ws/foo/foo_test.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar", "example.com/baz": "//baz:baz"}),
+				},
+				{
+					ID:      "example.com/foo_test [//foo:foo_test]",
+					PkgPath: "example.com/foo_test",
+					GoFiles: []string{"/ws/foo/ext_test.go"},
+					Imports: imports(map[string]string{"example.com/baz": "//baz:baz"}),
+				},
+				{
+					ID:      "//foo:foo",
+					PkgPath: "example.com/foo",
+					GoFiles: []string{"/ws/foo/foo.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar"}),
+				},
+				barPackage,
+				bazPackage,
+			},
+		},
+		{
+			name: "cgo",
+			targets: []*blaze_query.Target{
+				rule("go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:11",
+					stringAttr("importpath", "example.com/foo"),
+					listAttr("srcs", "//foo:foo.go", "//foo:cgo.go"),
+					boolAttr("cgo", true),
+				),
+			},
+			generated: GeneratedFiles{"//foo:foo": {"/out/foo/foo.go", "/out/foo/cgo.cgo1.go", "/out/foo/_cgo_gotypes.go", "/out/foo/foo.a"}},
+			want: []*packages.Package{
+				{
+					ID:              "//foo:foo",
+					PkgPath:         "example.com/foo",
+					GoFiles:         []string{"/ws/foo/foo.go", "/ws/foo/cgo.go"},
+					CompiledGoFiles: []string{"/ws/foo/foo.go", "/out/foo/cgo.cgo1.go", "/out/foo/_cgo_gotypes.go"},
+					Imports:         imports(nil),
+				},
+			},
+		},
+		{
+			name: "go_binary",
+			targets: []*blaze_query.Target{
+				rule("go_binary", "//cmd/foo:foo", "/ws/cmd/foo/BUILD.bazel:1:10",
+					listAttr("srcs", "//cmd/foo:main.go"),
+					listAttr("embed", "//cmd/foo:lib"),
+					listAttr("deps", "//baz:baz"),
+				),
+				rule("go_library", "//cmd/foo:lib", "/ws/cmd/foo/BUILD.bazel:7:11",
+					stringAttr("importpath", "example.com/cmd/foo/lib"),
+					listAttr("srcs", "//cmd/foo:lib.go"),
+					listAttr("deps", "//bar:bar"),
+				),
+				rule("go_binary", "//cmd/bar:bin", "/ws/cmd/bar/BUILD.bazel:1:10",
+					listAttr("srcs", "//cmd/bar:main.go"),
+				),
+				barLibrary,
+				bazLibrary,
+			},
+			want: []*packages.Package{
+				{
+					ID:      "//cmd/foo:foo",
+					PkgPath: "example.com/cmd/foo/lib",
+					GoFiles: []string{"/ws/cmd/foo/main.go", "/ws/cmd/foo/lib.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar", "example.com/baz": "//baz:baz"}),
+				},
+				{
+					ID:      "//cmd/foo:lib",
+					PkgPath: "example.com/cmd/foo/lib",
+					GoFiles: []string{"/ws/cmd/foo/lib.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar"}),
+				},
+				{
+					ID:      "//cmd/bar:bin",
+					PkgPath: "cmd/bar/bin",
+					GoFiles: []string{"/ws/cmd/bar/main.go"},
+					Imports: imports(nil),
+				},
+				barPackage,
+				bazPackage,
+			},
+		},
+		{
+			name: "go_source",
+			targets: []*blaze_query.Target{
+				rule("go_source", "//foo:srcs", "/ws/foo/BUILD.bazel:1:10",
+					listAttr("srcs", "//foo:srcs.go"),
+					listAttr("deps", "//bar:bar"),
+				),
+				barLibrary,
+			},
+			want: []*packages.Package{
+				{
+					ID:      "//foo:srcs",
+					PkgPath: "foo/srcs",
+					GoFiles: []string{"/ws/foo/srcs.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar"}),
+				},
+				barPackage,
+			},
+		},
+		{
+			name: "embedded go_source",
+			targets: []*blaze_query.Target{
+				rule("go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:11",
+					stringAttr("importpath", "example.com/foo"),
+					listAttr("srcs", "//foo:foo.go"),
+					listAttr("embed", "//foo:srcs"),
+				),
+				rule("go_source", "//foo:srcs", "/ws/foo/BUILD.bazel:7:10",
+					listAttr("srcs", "//foo:srcs.go"),
+					listAttr("deps", "//bar:bar"),
+				),
+				barLibrary,
+			},
+			want: []*packages.Package{
+				{
+					ID:      "//foo:foo",
+					PkgPath: "example.com/foo",
+					GoFiles: []string{"/ws/foo/foo.go", "/ws/foo/srcs.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar"}),
+				},
+				barPackage,
+			},
+		},
+		{
+			name: "go_binary embedding go_source",
+			targets: []*blaze_query.Target{
+				rule("go_binary", "//cmd/gen:gen", "/ws/cmd/gen/BUILD.bazel:1:10",
+					listAttr("embed", "//cmd/gen:srcs"),
+				),
+				rule("go_source", "//cmd/gen:srcs", "/ws/cmd/gen/BUILD.bazel:5:10",
+					listAttr("srcs", "//cmd/gen:main.go"),
+					listAttr("deps", "//bar:bar"),
+				),
+				barLibrary,
+			},
+			want: []*packages.Package{
+				{
+					ID:      "//cmd/gen:gen",
+					PkgPath: "cmd/gen",
+					GoFiles: []string{"/ws/cmd/gen/main.go"},
+					Imports: imports(map[string]string{"example.com/bar": "//bar:bar"}),
+				},
+				barPackage,
+			},
+		},
+		{
+			name: "ignored rules",
+			targets: []*blaze_query.Target{
+				rule("go_tool_library", "//foo:tool", "/ws/foo/BUILD.bazel:1:16",
+					stringAttr("importpath", "example.com/foo"),
+					listAttr("srcs", "//foo:foo.go"),
+				),
+				rule("go_binary", "//foo:bin", "/ws/foo/BUILD.bazel:7:10",
+					listAttr("embed", "//foo:tool"),
+				),
+				rule("alias", "//foo:missing", "/ws/foo/BUILD.bazel:12:6",
+					labelAttr("actual", "//other:target"),
+				),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &driver.Request{Overlay: overlay}
+			got := byID(Load(cfg, tc.targets, tc.generated, nil))
+			want := byID(tc.want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Load() =\n%v\nwant\n%v", dump(got), dump(want))
+			}
+		})
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	targets := []*blaze_query.Target{
+		fooLibrary,
+		fooGoProto,
+		fooTest,
+		rule("go_embed_data", "//foo:data", "/ws/foo/BUILD.bazel:7:14"),
+		rule("go_library", "//foo:cgo", "/ws/foo/BUILD.bazel:1:11",
+			stringAttr("importpath", "example.com/foo/cgo"),
+			boolAttr("cgo", true),
+		),
+		rule("go_library", "//foo:nocgo", "/ws/foo/BUILD.bazel:1:11",
+			stringAttr("importpath", "example.com/foo/nocgo"),
+			boolAttr("cgo", false),
+		),
+	}
+	got := Generators(targets, nil)
+	sort.Strings(got)
+	want := []string{"//foo:cgo", "//foo:data", "//foo:foo_go_proto", "//foo:foo_test"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Generators() = %v, want %v", got, want)
+	}
+}
+
+// byID indexes pkgs by ID. Aliases return a copy of the actual package,
+// so the same ID may appear more than once in the result of Load.
+func byID(pkgs []*packages.Package) map[string]*packages.Package {
+	result := make(map[string]*packages.Package, len(pkgs))
+	for _, pkg := range pkgs {
+		result[pkg.ID] = pkg
+	}
+	return result
+}
+
+func dump(pkgs map[string]*packages.Package) string {
+	data, err := json.MarshalIndent(pkgs, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func TestBinpath(t *testing.T) {
+	tests := map[string]string{
+		"//foo/bar:baz": "bazel-bin/foo/bar",
+		"//foo/bar":     "bazel-bin/foo/bar",
+		"@//foo:foo":    "bazel-bin/foo",
+		"@@//foo:foo":   "bazel-bin/foo",
+		"@com_github_foo//bar:go_default_library":          "bazel-bin/external/com_github_foo/bar",
+		"@@gazelle~~go_deps~com_github_foo//bar:bar":       "bazel-bin/external/gazelle~~go_deps~com_github_foo/bar",
+		"@@rules_go~~go_sdk~go_default_sdk//:package_list": "bazel-bin/external/rules_go~~go_sdk~go_default_sdk",
+	}
+	for label, want := range tests {
+		if got := binpath(label); got != want {
+			t.Errorf("binpath(%v) = %v, want %v", label, got, want)
+		}
+	}
+}
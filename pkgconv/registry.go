@@ -0,0 +1,232 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkgconv
+
+import (
+	"sort"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"golang.org/x/tools/go/packages"
+)
+
+// Converter converts a target into packages.
+// Converters for library-like rules should set PkgPath and initialize Imports,
+// so other packages can depend on them.
+type Converter func(t Target, g *Graph) []*packages.Package
+
+// builtinConverter returns the converter for a rules_go rule, or nil.
+func builtinConverter(rule string) func(t target, g *graph) []*packages.Package {
+	switch rule {
+	case "go_library":
+		return convertGoLibrary
+	case "go_proto_library":
+		return convertGoProtoLibrary
+	case "go_test":
+		return convertGoTest
+	case "go_binary":
+		return convertGoBinary
+	case "go_source":
+		return convertGoSource
+	}
+	return nil
+}
+
+// registration is a converter added with Register, and its options.
+type registration struct {
+	convert          Converter
+	generatesSources bool
+}
+
+// registered are the converters added with Register.
+var registered = make(map[string]*registration)
+
+// Option changes how the driver handles a rule class added with Register.
+type Option func(*registration)
+
+// GeneratesSources marks a rule class whose actions write go files. The
+// driver runs aquery on its targets to find them, and they're available from
+// Graph.GeneratedFiles.
+func GeneratesSources() Option {
+	return func(r *registration) { r.generatesSources = true }
+}
+
+// Register sets the converter for targets with the rule class ruleClass,
+// replacing the builtin converter if there is one. It lets a wrapper binary
+// that calls driver.Run support the rules of an organization.
+// Register isn't safe for concurrent use, so call it before the driver
+// starts, for example from an init function.
+//
+// The driver queries for registered rule classes along with the go rules.
+// The rule class is also recorded with driver.RegisterExtension, so the
+// requests of the wrapper binary are only handled by a daemon that has the
+// same converters.
+func Register(ruleClass string, c Converter, opts ...Option) {
+	r := &registration{convert: c}
+	for _, opt := range opts {
+		opt(r)
+	}
+	registered[ruleClass] = r
+	driver.RegisterExtension("pkgconv:" + ruleClass)
+}
+
+// Registered returns the rule classes with a converter added with Register,
+// in sorted order.
+func Registered() []string {
+	var classes []string
+	for class := range registered {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// Builtin returns the converter for one of the rules_go rules, or nil if
+// there isn't one. Converters can use it to handle a custom rule like one
+// of the rules it wraps.
+func Builtin(ruleClass string) Converter {
+	convert := builtinConverter(ruleClass)
+	if convert == nil {
+		return nil
+	}
+	return func(t Target, g *Graph) []*packages.Package {
+		return convert(t.t, g.g)
+	}
+}
+
+// Target is a rule from the query results.
+// The standard rules_go attributes are read when the graph is built, with
+// their select()s resolved; the rest are available from Attr.
+type Target struct {
+	t target
+}
+
+// Name returns the label of the target.
+func (t Target) Name() string { return t.t.name }
+
+// RuleClass returns the rule class of the target. For custom kinds from the
+// config file, this is the rules_go rule it behaves like.
+func (t Target) RuleClass() string { return t.t.rule }
+
+// Dir returns the directory of the BUILD file that defines the target.
+func (t Target) Dir() string { return t.t.folder }
+
+// Importpath returns the importpath attribute.
+func (t Target) Importpath() string { return t.t.importpath }
+
+// Srcs returns the labels in the srcs attribute.
+func (t Target) Srcs() []string { return t.t.srcs }
+
+// Deps returns the labels in the deps attribute.
+func (t Target) Deps() []string { return t.t.deps }
+
+// Embed returns the labels in the embed attribute.
+func (t Target) Embed() []string { return t.t.embed }
+
+// Attr returns the attribute called name, or nil if the rule doesn't have it.
+// Use Graph.StringList or Graph.StringValue to read it.
+func (t Target) Attr(name string) *blaze_query.Attribute {
+	for _, a := range t.t.attrs {
+		if a.GetName() == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// WithImportpath returns a copy of t with a different importpath, for
+// converters that compute it before calling a Builtin converter.
+func (t Target) WithImportpath(importpath string) Target {
+	t.t.importpath = importpath
+	return t
+}
+
+// WithSrcs returns a copy of t with different srcs.
+func (t Target) WithSrcs(srcs []string) Target {
+	t.t.srcs = srcs
+	return t
+}
+
+// WithDeps returns a copy of t with different deps.
+func (t Target) WithDeps(deps []string) Target {
+	t.t.deps = deps
+	return t
+}
+
+// Graph is the set of targets being converted.
+type Graph struct {
+	g *graph
+}
+
+// Request returns the driver request the packages are loaded for.
+func (g *Graph) Request() *driver.Request { return g.g.cfg }
+
+// Target returns the target with the label name, or false if it isn't in the graph.
+func (g *Graph) Target(name string) (Target, bool) {
+	t := g.g.targets[name]
+	if t == nil {
+		return Target{}, false
+	}
+	return Target{*t}, true
+}
+
+// GeneratedFiles returns the go files written by the actions of the target name.
+func (g *Graph) GeneratedFiles(name string) []string { return g.g.generated[name] }
+
+// StringList returns the value of a list attribute, resolving select() the same
+// way as the standard attributes.
+func (g *Graph) StringList(a *blaze_query.Attribute) []string { return g.g.sel.stringList(a) }
+
+// StringValue returns the value of a string or label attribute, resolving
+// select() the same way as the standard attributes.
+func (g *Graph) StringValue(a *blaze_query.Attribute) string { return g.g.sel.stringValue(a) }
+
+// SrcPath returns the path of a label in the srcs of t, or "" if it can't be found.
+func (g *Graph) SrcPath(t Target, src string) string { return srcPath(t.t, g.g, src) }
+
+// AddSrcs adds the srcs of t to the GoFiles and OtherFiles of pkg.
+func (g *Graph) AddSrcs(t Target, pkg *packages.Package) { processGoSrcs(t.t, g.g, pkg) }
+
+// AddDeps adds the deps of t to the Imports of pkg, which must not be nil.
+func (g *Graph) AddDeps(t Target, pkg *packages.Package) { processDeps(t.t, g.g, pkg) }
+
+// convertRegistered converts t with a registered converter. The packages are
+// saved, since they're also needed to find the PkgPath of t for the targets
+// that depend on it.
+func (g *graph) convertRegistered(t target, convert Converter) []*packages.Package {
+	if pkgs, ok := g.converted[t.name]; ok {
+		return pkgs
+	}
+	pkgs := convert(Target{t}, &Graph{g})
+	if g.converted == nil {
+		g.converted = make(map[string][]*packages.Package)
+	}
+	g.converted[t.name] = pkgs
+	return pkgs
+}
+
+// registeredPkgPath returns the PkgPath of a target with a registered converter.
+// Converters can compute the importpath, so the target is converted to find it.
+func (g *graph) registeredPkgPath(t *target) string {
+	if t.importpath != "" {
+		return t.importpath
+	}
+	for _, pkg := range g.convertRegistered(*t, registered[t.rule].convert) {
+		if pkg.ID == t.name {
+			return pkg.PkgPath
+		}
+	}
+	return ""
+}
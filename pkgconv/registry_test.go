@@ -0,0 +1,85 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkgconv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"golang.org/x/tools/go/packages"
+)
+
+func TestRegister(t *testing.T) {
+	// acme_go_library computes the importpath from a module attribute.
+	Register("acme_go_library", func(t Target, g *Graph) []*packages.Package {
+		module := g.StringValue(t.Attr("module"))
+		_, pkg, _ := splitLabel(t.Name())
+		return Builtin("go_library")(t.WithImportpath(module+"/"+pkg), g)
+	}, GeneratesSources())
+	Register("acme_go_alias", func(t Target, g *Graph) []*packages.Package { return nil })
+	t.Cleanup(func() {
+		delete(registered, "acme_go_library")
+		delete(registered, "acme_go_alias")
+	})
+
+	if got, want := Registered(), []string{"acme_go_alias", "acme_go_library"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Registered() = %v, want %v", got, want)
+	}
+	targets := []*blaze_query.Target{
+		barLibrary,
+		rule("acme_go_library", "//foo:foo", "/ws/foo/BUILD.bazel:1:16",
+			stringAttr("module", "acme.com/repo"),
+			listAttr("srcs", "//foo:foo.go"),
+			listAttr("deps", "//bar:bar"),
+		),
+		rule("go_library", "//baz:baz", "/ws/baz/BUILD.bazel:1:11",
+			stringAttr("importpath", "example.com/baz"),
+			listAttr("srcs", "//baz:baz.go"),
+			listAttr("deps", "//foo:foo"),
+		),
+	}
+	// acme_go_alias doesn't generate sources, so it doesn't need aquery.
+	generators := append(targets, rule("acme_go_alias", "//foo:alias", "/ws/foo/BUILD.bazel:9:14"))
+	if got, want := Generators(generators, nil), []string{"//foo:foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Generators() = %v, want %v", got, want)
+	}
+	cfg := &driver.Request{Overlay: map[string][]byte{"/ws/foo/foo.go": []byte("package foo\n")}}
+	got := byID(Load(cfg, targets, nil, nil))
+	want := byID([]*packages.Package{
+		{
+			ID:      "//bar:bar",
+			PkgPath: "example.com/bar",
+			GoFiles: []string{"/ws/bar/bar.go"},
+			Imports: imports(nil),
+		},
+		{
+			ID:      "//foo:foo",
+			PkgPath: "acme.com/repo/foo",
+			GoFiles: []string{"/ws/foo/foo.go"},
+			Imports: imports(map[string]string{"example.com/bar": "//bar:bar"}),
+		},
+		{
+			ID:      "//baz:baz",
+			PkgPath: "example.com/baz",
+			GoFiles: []string{"/ws/baz/baz.go"},
+			Imports: imports(map[string]string{"acme.com/repo/foo": "//foo:foo"}),
+		},
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() =\n%v\nwant\n%v", dump(got), dump(want))
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkgconv
+
+import (
+	"strings"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/derivita/bazelpackagesdriver/driver"
+)
+
+// SelectEnv is the environment variable that sets how select() is resolved
+// in the attributes of go rules.
+const SelectEnv = "GOPACKAGESDRIVER_SELECT"
+
+const (
+	// SelectPlatform picks the branches whose conditions match GOOS and GOARCH.
+	// If none of the conditions are platforms, the default branch is used,
+	// or all the branches if there is no default.
+	SelectPlatform = "platform"
+	// SelectUnion uses all the branches.
+	SelectUnion = "union"
+)
+
+const defaultCondition = "//conditions:default"
+
+// platformOS and platformCPU map GOOS and GOARCH to the constraint values in @platforms
+// when they have different names. GOARCH=arm is armv7 only with GOARM=7.
+var platformOS = map[string]string{
+	"darwin": "osx",
+}
+
+var platformCPU = map[string]string{
+	"386":   "x86_32",
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+}
+
+// selector resolves the select() calls in attributes.
+type selector struct {
+	policy string
+	goos   string
+	goarch string
+	goarm  string
+}
+
+func newSelector(cfg *driver.Request, goos, goarch string) *selector {
+	return &selector{
+		policy: driver.GetEnv(cfg, SelectEnv, SelectPlatform),
+		goos:   goos,
+		goarch: goarch,
+		goarm:  driver.GetEnv(cfg, "GOARM", ""),
+	}
+}
+
+// stringList returns the value of a list attribute.
+// Each select() in the attribute is replaced with the branches chosen by the policy.
+func (s *selector) stringList(a *blaze_query.Attribute) []string {
+	if a.GetSelectorList() == nil {
+		return a.GetStringListValue()
+	}
+	var result []string
+	for _, e := range s.entries(a) {
+		result = append(result, e.GetStringListValue()...)
+	}
+	return result
+}
+
+// stringValue returns the value of a string or label attribute.
+// If the attribute is a select(), the first branch chosen by the policy is used.
+func (s *selector) stringValue(a *blaze_query.Attribute) string {
+	if a.GetSelectorList() == nil {
+		return a.GetStringValue()
+	}
+	for _, e := range s.entries(a) {
+		if v := e.GetStringValue(); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// boolValue returns the value of a boolean attribute.
+// If the attribute is a select(), it's true if any branch chosen by the policy is.
+func (s *selector) boolValue(a *blaze_query.Attribute) bool {
+	if a.GetSelectorList() == nil {
+		return a.GetBooleanValue()
+	}
+	for _, e := range s.entries(a) {
+		if e.GetBooleanValue() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *selector) entries(a *blaze_query.Attribute) []*blaze_query.Attribute_SelectorEntry {
+	var result []*blaze_query.Attribute_SelectorEntry
+	for _, sel := range a.GetSelectorList().GetElements() {
+		result = append(result, s.choose(sel.GetEntries())...)
+	}
+	return result
+}
+
+// choose returns the entries of a single select() to use.
+func (s *selector) choose(entries []*blaze_query.Attribute_SelectorEntry) []*blaze_query.Attribute_SelectorEntry {
+	if s.policy == SelectUnion {
+		return entries
+	}
+	var matched, defaults []*blaze_query.Attribute_SelectorEntry
+	for _, e := range entries {
+		if e.GetLabel() == defaultCondition {
+			defaults = append(defaults, e)
+		} else if s.matchPlatform(e.GetLabel()) {
+			matched = append(matched, e)
+		}
+	}
+	if len(matched) > 0 {
+		return matched
+	} else if len(defaults) > 0 {
+		return defaults
+	}
+	return entries
+}
+
+// matchPlatform reports whether a config_setting label selects the target platform.
+// It understands the rules_go go/platform settings and the @platforms constraints.
+func (s *selector) matchPlatform(label string) bool {
+	parts := strings.SplitN(label, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	pkg, name := parts[0], parts[1]
+	switch {
+	case strings.HasSuffix(pkg, "//go/platform"):
+		return name == s.goos || name == s.goarch || name == s.goos+"_"+s.goarch
+	case strings.HasSuffix(pkg, "//os"):
+		return name == s.goos || name == platformOS[s.goos] || s.goos == "darwin" && name == "macos"
+	case strings.HasSuffix(pkg, "//cpu"):
+		return name == s.goarch || name == platformCPU[s.goarch] || s.goarch == "arm" && s.goarm == "7" && name == "armv7"
+	}
+	return false
+}
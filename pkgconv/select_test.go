@@ -0,0 +1,178 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkgconv
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"github.com/golang/protobuf/proto"
+)
+
+// selectAttr returns a list attribute with one select() for each map in selects.
+func selectAttr(name string, selects ...map[string][]string) *blaze_query.Attribute {
+	list := &blaze_query.Attribute_SelectorList{Type: blaze_query.Attribute_LABEL_LIST.Enum()}
+	for _, branches := range selects {
+		sel := &blaze_query.Attribute_Selector{}
+		for label, values := range branches {
+			sel.Entries = append(sel.Entries, &blaze_query.Attribute_SelectorEntry{
+				Label:           proto.String(label),
+				StringListValue: values,
+			})
+		}
+		list.Elements = append(list.Elements, sel)
+	}
+	return &blaze_query.Attribute{
+		Name:         proto.String(name),
+		Type:         blaze_query.Attribute_SELECTOR_LIST.Enum(),
+		SelectorList: list,
+	}
+}
+
+func TestSelectorStringList(t *testing.T) {
+	platforms := map[string][]string{
+		"@io_bazel_rules_go//go/platform:linux":   {"//foo:linux"},
+		"@io_bazel_rules_go//go/platform:windows": {"//foo:windows"},
+		"@platforms//cpu:x86_64":                  {"//foo:amd64"},
+		"//conditions:default":                    {"//foo:default"},
+	}
+	custom := map[string][]string{
+		"//config:special": {"//foo:special"},
+		"//config:other":   {"//foo:other"},
+	}
+	tests := []struct {
+		name string
+		env  []string
+		attr *blaze_query.Attribute
+		want []string
+	}{
+		{
+			name: "plain list",
+			attr: listAttr("deps", "//foo:a", "//foo:b"),
+			want: []string{"//foo:a", "//foo:b"},
+		},
+		{
+			name: "linux",
+			env:  []string{"GOOS=linux", "GOARCH=arm64"},
+			attr: selectAttr("deps", map[string][]string{"//conditions:default": {"//foo:common"}}, platforms),
+			want: []string{"//foo:common", "//foo:linux"},
+		},
+		{
+			name: "darwin falls back to default",
+			env:  []string{"GOOS=darwin", "GOARCH=arm64"},
+			attr: selectAttr("deps", platforms),
+			want: []string{"//foo:default"},
+		},
+		{
+			name: "unknown conditions",
+			env:  []string{"GOOS=linux", "GOARCH=amd64"},
+			attr: selectAttr("deps", custom),
+			want: []string{"//foo:other", "//foo:special"},
+		},
+		{
+			name: "union",
+			env:  []string{"GOOS=linux", "GOARCH=arm64", SelectEnv + "=" + SelectUnion},
+			attr: selectAttr("deps", platforms),
+			want: []string{"//foo:amd64", "//foo:default", "//foo:linux", "//foo:windows"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &driver.Request{Env: tc.env}
+			ctxt := BuildContext(cfg)
+			got := newSelector(cfg, ctxt.GOOS, ctxt.GOARCH).stringList(tc.attr)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("stringList() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	s := &selector{goos: "darwin", goarch: "amd64"}
+	tests := map[string]bool{
+		"@io_bazel_rules_go//go/platform:darwin":       true,
+		"@io_bazel_rules_go//go/platform:darwin_amd64": true,
+		"@rules_go//go/platform:amd64":                 true,
+		"@io_bazel_rules_go//go/platform:linux_amd64":  false,
+		"@platforms//os:macos":                         true,
+		"@platforms//os:osx":                           true,
+		"@platforms//os:linux":                         false,
+		"@platforms//cpu:x86_64":                       true,
+		"//config:darwin":                              false,
+	}
+	for label, want := range tests {
+		if got := s.matchPlatform(label); got != want {
+			t.Errorf("matchPlatform(%v) = %v, want %v", label, got, want)
+		}
+	}
+}
+
+func TestMatchPlatformCPU(t *testing.T) {
+	tests := []struct {
+		goarch, goarm, label string
+		want                 bool
+	}{
+		{goarch: "ppc64le", label: "@platforms//cpu:ppc64le", want: true},
+		{goarch: "ppc64le", label: "@platforms//cpu:ppc", want: false},
+		{goarch: "arm", goarm: "7", label: "@platforms//cpu:armv7", want: true},
+		{goarch: "arm", goarm: "6", label: "@platforms//cpu:armv7", want: false},
+		{goarch: "arm", goarm: "6", label: "@platforms//cpu:arm", want: true},
+		{goarch: "arm64", label: "@platforms//cpu:aarch64", want: true},
+	}
+	for _, tc := range tests {
+		s := &selector{goos: "linux", goarch: tc.goarch, goarm: tc.goarm}
+		if got := s.matchPlatform(tc.label); got != tc.want {
+			t.Errorf("matchPlatform(%v) for GOARCH=%v GOARM=%v = %v, want %v", tc.label, tc.goarch, tc.goarm, got, tc.want)
+		}
+	}
+}
+
+func TestSelectorBoolValue(t *testing.T) {
+	cgo := &blaze_query.Attribute{
+		Name: proto.String("cgo"),
+		Type: blaze_query.Attribute_SELECTOR_LIST.Enum(),
+		SelectorList: &blaze_query.Attribute_SelectorList{
+			Type: blaze_query.Attribute_BOOLEAN.Enum(),
+			Elements: []*blaze_query.Attribute_Selector{{
+				Entries: []*blaze_query.Attribute_SelectorEntry{
+					{Label: proto.String("@io_bazel_rules_go//go/platform:linux"), BooleanValue: proto.Bool(true)},
+					{Label: proto.String(defaultCondition), BooleanValue: proto.Bool(false)},
+				},
+			}},
+		},
+	}
+	tests := []struct {
+		policy, goos string
+		want         bool
+	}{
+		{policy: SelectPlatform, goos: "linux", want: true},
+		{policy: SelectPlatform, goos: "windows", want: false},
+		{policy: SelectUnion, goos: "windows", want: true},
+	}
+	for _, tc := range tests {
+		s := &selector{policy: tc.policy, goos: tc.goos, goarch: "amd64"}
+		if got := s.boolValue(cgo); got != tc.want {
+			t.Errorf("boolValue() with %v policy on %v = %v, want %v", tc.policy, tc.goos, got, tc.want)
+		}
+	}
+	if got := (&selector{}).boolValue(&blaze_query.Attribute{BooleanValue: proto.Bool(true)}); !got {
+		t.Errorf("boolValue() without select = %v, want true", got)
+	}
+}
@@ -19,9 +19,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/bazelbuild/bazel-watcher/bazel"
 	"github.com/derivita/bazelpackagesdriver/driver"
 	"golang.org/x/tools/go/packages"
 )
@@ -31,18 +31,30 @@ type gosdk struct {
 	packages map[string]bool
 }
 
-func newGoSDK(bazel bazel.Bazel) (*gosdk, error) {
+// sdkRepos are the names the go sdk repository may have.
+// WORKSPACE setups use go_sdk. With bzlmod the default sdk created by the rules_go
+// go_sdk extension has a canonical name that depends on the bazel version.
+// GOPACKAGESDRIVER_GO_SDK can be set to the name of any other sdk repository.
+var sdkRepos = []string{
+	"@go_sdk",
+	"@@rules_go~~go_sdk~go_default_sdk",
+	"@@rules_go++go_sdk+go_default_sdk",
+	"@@rules_go~go_sdk~go_default_sdk",
+}
+
+func newGoSDK(cfg *driver.Request, bazel Bazel) (*gosdk, error) {
 	info, err := bazel.Info()
 	if err != nil {
 		return nil, err
 	}
 	bazelBin := info["bazel-bin"]
-	_, err = bazel.Build("@go_sdk//:package_list")
+
+	repo, root, err := findGoroot(cfg, bazel)
 	if err != nil {
 		return nil, err
 	}
 
-	root, err := findGoroot(bazel)
+	_, err = bazel.Build(repo + "//:package_list")
 	if err != nil {
 		return nil, err
 	}
@@ -51,7 +63,9 @@ func newGoSDK(bazel bazel.Bazel) (*gosdk, error) {
 		goroot: root,
 	}
 
-	return s.readPackages(filepath.Join(bazelBin, "external/go_sdk/packages.txt"))
+	// The directory in external is always the canonical name of the repository,
+	// which is the name of the directory containing the sdk.
+	return s.readPackages(filepath.Join(bazelBin, "external", filepath.Base(root), "packages.txt"))
 }
 
 func (s *gosdk) readPackages(filename string) (*gosdk, error) {
@@ -79,10 +93,12 @@ func (s *gosdk) loadPackages(cfg *driver.Request, pkgs map[string]bool) ([]*pack
 		return nil, nil
 	}
 
+	_, goFlags := splitBuildFlags(cfg.BuildFlags)
 	sdkConfig := &packages.Config{
-		Mode:       cfg.Mode,
+		// Syntax and types can't be returned to go/packages, so don't waste time on them here.
+		Mode:       cfg.Mode &^ typecheckModes,
 		Env:        append(cfg.Env, fmt.Sprintf("GOROOT=%v", s.goroot), "GOPACKAGESDRIVER=off"),
-		BuildFlags: cfg.BuildFlags,
+		BuildFlags: goFlags,
 		Tests:      cfg.Tests,
 	}
 
@@ -93,6 +109,14 @@ func (s *gosdk) loadPackages(cfg *driver.Request, pkgs map[string]bool) ([]*pack
 	var result []*packages.Package
 	for i := 0; i < 5; i++ {
 		if result, err = packages.Load(sdkConfig, words...); err == nil {
+			if cfg.Mode&packages.NeedDeps != 0 {
+				// Load only returns the roots, but the response needs the whole graph.
+				var all []*packages.Package
+				packages.Visit(result, nil, func(pkg *packages.Package) {
+					all = append(all, pkg)
+				})
+				result = all
+			}
 			return result, nil
 		}
 		time.Sleep(1 * time.Millisecond)
@@ -100,11 +124,37 @@ func (s *gosdk) loadPackages(cfg *driver.Request, pkgs map[string]bool) ([]*pack
 	return nil, err
 }
 
-func findGoroot(bazel bazel.Bazel) (string, error) {
-	results, err := bazel.Query("@go_sdk//:ROOT")
-	if err != nil {
-		return "", err
+// findGoroot returns the name of the go sdk repository and the directory it's in.
+func findGoroot(cfg *driver.Request, bazel Bazel) (repo, goroot string, err error) {
+	repos := sdkRepos
+	if env := driver.GetEnv(cfg, "GOPACKAGESDRIVER_GO_SDK", ""); env != "" {
+		repos = []string{"@" + strings.TrimLeft(env, "@")}
+	}
+	for _, repo := range repos {
+		results, qerr := bazel.Query(repo + "//:ROOT")
+		if qerr != nil {
+			err = qerr
+			continue
+		}
+		if len(results.GetTarget()) == 0 {
+			err = fmt.Errorf("no ROOT in %v", repo)
+			continue
+		}
+		buildfile := results.GetTarget()[0].GetSourceFile().GetLocation()
+		return repo, filepath.Dir(buildfile), nil
+	}
+	return "", "", fmt.Errorf("couldn't find the go sdk repository: %w", err)
+}
+
+// gorootPrefix returns the path of the sdk repository through the
+// bazel-<workspace> symlink if filename is inside it.
+func (s *gosdk) gorootPrefix(filename string) string {
+	parts := strings.SplitN(filepath.ToSlash(filename), "/", 4)
+	if len(parts) < 3 || !strings.HasPrefix(parts[0], "bazel-") || parts[1] != "external" {
+		return ""
+	}
+	if parts[2] != filepath.Base(s.goroot) {
+		return ""
 	}
-	buildfile := results.Target[0].GetSourceFile().GetLocation()
-	return filepath.Dir(buildfile), nil
+	return strings.Join(parts[:3], "/")
 }
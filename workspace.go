@@ -0,0 +1,521 @@
+// Copyright 2021 Derivita Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazelpackagesdriver
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/blaze_query"
+	"github.com/derivita/bazelpackagesdriver/driver"
+	"github.com/derivita/bazelpackagesdriver/pkgconv"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/tools/go/packages"
+)
+
+// cacheVersion is part of the cache filename, so it needs to change whenever
+// the format of the cache, or the packages stored in it, changes.
+const cacheVersion = 7
+
+// workspace is the state that is kept between requests for the same directory.
+// In daemon mode it stays in memory, and it's also saved in the user cache
+// directory so repeated loads of an unchanged workspace don't need to run bazel.
+type workspace struct {
+	Root     string
+	ExecRoot string
+	GOROOT   string
+	// OwnOutputBase is set when the driver has its own output base, so the
+	// bazel-bin symlink in the workspace isn't where its outputs are.
+	OwnOutputBase bool
+	// BazelBin is the bazel-bin of the driver's output base for the bazel
+	// flags of each request, since they can change the configuration.
+	BazelBin map[string]string
+	Stdlib   []string
+	// Stamps are for the files that affect the bazel info and sdk.
+	Stamps   map[string]fileStamp
+	Queries  map[string]*cachedQuery
+	Packages map[string]*cachedPackages
+	Files    map[string]*parsedFile
+	Index    *fileIndex
+
+	sdk       *gosdk
+	cacheFile string
+	dirty     bool
+}
+
+// fileStamp is used to detect changes to a file.
+// Hash is only checked if the modification time has changed, so touching
+// a BUILD file doesn't invalidate the cache.
+type fileStamp struct {
+	ModTime time.Time
+	Size    int64
+	Hash    string `json:",omitempty"`
+}
+
+// cachedQuery is a query result, along with the stamps of the BUILD and .bzl
+// files (and for wildcard queries, the directories) it was computed from.
+type cachedQuery struct {
+	Result []byte
+	Stamps map[string]fileStamp
+}
+
+// cachedPackages are the packages converted from a query, before the sources are parsed.
+type cachedPackages struct {
+	Packages json.RawMessage
+	Aliases  map[string]string
+	Stamps   map[string]fileStamp
+}
+
+// parsedFile is the package clause and imports of a source file.
+type parsedFile struct {
+	Stamp   fileStamp
+	Name    string
+	Imports []string
+}
+
+// workspaceStampFiles can change the bazel info and sdk for a workspace.
+var workspaceStampFiles = []string{"WORKSPACE", "WORKSPACE.bazel", "MODULE.bazel", ".bazelrc", ".bazelversion", configFile}
+
+type workspaces struct {
+	mu    sync.Mutex
+	byDir map[string]*workspace
+}
+
+// get returns the workspace for dir, loading it from the cache directory or
+// creating it if this is the first request from dir.
+// If bazel info fails, dir isn't in a bazel workspace and get returns nil.
+// A separate output base or go sdk has its own workspace, since the bazel info
+// or sdk is different.
+func (w *workspaces) get(dir string, cfg *driver.Request, c *config, bzl Bazel) (*workspace, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	key := dir
+	if c.OutputBase != "" {
+		key += string(filepath.ListSeparator) + c.OutputBase
+	}
+	if sdk := driver.GetEnv(cfg, "GOPACKAGESDRIVER_GO_SDK", ""); sdk != "" {
+		key += string(filepath.ListSeparator) + sdk
+	}
+	if ws := w.byDir[key]; ws != nil && stampsMatch(ws.Stamps) {
+		return ws, nil
+	}
+	ws := loadWorkspace(key)
+	if ws == nil {
+		info, err := bzl.Info()
+		if err != nil {
+			log.Printf("bazel info: %v", err)
+			return nil, nil
+		}
+		sdk, err := newGoSDK(cfg, bzl)
+		if err != nil {
+			return nil, err
+		}
+		ws = &workspace{
+			Root:      info["workspace"],
+			ExecRoot:  info["execution_root"],
+			GOROOT:    sdk.goroot,
+			Stamps:    make(map[string]fileStamp),
+			Queries:   make(map[string]*cachedQuery),
+			Packages:  make(map[string]*cachedPackages),
+			Files:     make(map[string]*parsedFile),
+			BazelBin:  make(map[string]string),
+			sdk:       sdk,
+			cacheFile: cacheFilename(key),
+			dirty:     true,
+		}
+		ws.OwnOutputBase = c.OutputBase != ""
+		for pkg := range sdk.packages {
+			ws.Stdlib = append(ws.Stdlib, pkg)
+		}
+		for _, name := range workspaceStampFiles {
+			filename := filepath.Join(ws.Root, name)
+			ws.Stamps[filename] = newStamp(filename)
+		}
+	}
+	if w.byDir == nil {
+		w.byDir = make(map[string]*workspace)
+	}
+	w.byDir[key] = ws
+	return ws, nil
+}
+
+// cacheFilename returns the file used to save the workspace for key,
+// which is the directory the driver runs in, and the output base and go sdk
+// if they're set.
+func cacheFilename(key string) string {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(cache, "bazelpackagesdriver", fmt.Sprintf("v%d-%x.json", cacheVersion, sum[:8]))
+}
+
+// loadWorkspace reads the saved workspace for key, if it exists and the
+// workspace files haven't changed.
+func loadWorkspace(key string) *workspace {
+	filename := cacheFilename(key)
+	if filename == "" {
+		return nil
+	}
+	return readWorkspace(filename)
+}
+
+// readWorkspace reads a workspace saved in filename, if the workspace files
+// haven't changed.
+func readWorkspace(filename string) *workspace {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	var ws workspace
+	if err := json.Unmarshal(data, &ws); err != nil {
+		log.Printf("ignoring invalid cache %v: %v", filename, err)
+		return nil
+	}
+	if !stampsMatch(ws.Stamps) {
+		return nil
+	}
+	ws.cacheFile = filename
+	ws.sdk = &gosdk{goroot: ws.GOROOT, packages: make(map[string]bool, len(ws.Stdlib))}
+	for _, pkg := range ws.Stdlib {
+		ws.sdk.packages[pkg] = true
+	}
+	if ws.Queries == nil {
+		ws.Queries = make(map[string]*cachedQuery)
+	}
+	if ws.Packages == nil {
+		ws.Packages = make(map[string]*cachedPackages)
+	}
+	if ws.Files == nil {
+		ws.Files = make(map[string]*parsedFile)
+	}
+	if ws.BazelBin == nil {
+		ws.BazelBin = make(map[string]string)
+	}
+	log.Printf("loaded cache %v", filename)
+	return &ws
+}
+
+// save writes the workspace to the cache directory if it has changed.
+func (ws *workspace) save() error {
+	if !ws.dirty || ws.cacheFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(ws)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ws.cacheFile), 0777); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(ws.cacheFile), filepath.Base(ws.cacheFile))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), ws.cacheFile); err != nil {
+		return err
+	}
+	ws.dirty = false
+	return nil
+}
+
+var locationSuffix = regexp.MustCompile(`(:\d+)+$`)
+
+// query runs a bazel query, or returns the previous result if none of the
+// BUILD and .bzl files it depends on have changed.
+func (d *bazelDriver) query(expr string) (*blaze_query.QueryResult, error) {
+	key := d.queryKey(expr)
+	if cached := d.ws.Queries[key]; cached != nil && stampsMatch(cached.Stamps) {
+		var result blaze_query.QueryResult
+		if err := proto.Unmarshal(cached.Result, &result); err == nil {
+			log.Printf("cached bazel query %#v", expr)
+			return &result, nil
+		}
+	}
+	log.Printf("bazel query %#v", expr)
+	result, complete, err := d.runQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		return result, nil
+	}
+	stamps, err := d.buildfileStamps(expr, result)
+	if err != nil {
+		log.Printf("not caching %#v: %v", expr, err)
+		return result, nil
+	}
+	if data, err := proto.Marshal(result); err == nil {
+		d.ws.Queries[key] = &cachedQuery{
+			Result: data,
+			Stamps: stamps,
+		}
+		d.ws.dirty = true
+	}
+	return result, nil
+}
+
+// cachedPackages returns the packages previously converted from query, if
+// none of the files they were computed from have changed.
+// Each call returns new packages, so they can be modified by the caller.
+// The aliases in the query result are resolved like they are for a new query.
+func (d *bazelDriver) cachedPackages(query string) []*packages.Package {
+	cached := d.ws.Packages[d.packagesKey(query)]
+	if cached == nil || !stampsMatch(cached.Stamps) {
+		return nil
+	}
+	var pkgs []*packages.Package
+	if err := json.Unmarshal(cached.Packages, &pkgs); err != nil {
+		return nil
+	}
+	for _, pkg := range pkgs {
+		// The test packages are split up based on the package clause of each file.
+		if strings.Contains(pkg.ID, " [") {
+			for _, f := range pkg.GoFiles {
+				if driver.InOverlay(&d.cfg, f) {
+					return nil
+				}
+			}
+		}
+	}
+	log.Printf("cached packages for %#v", query)
+	d.resolveAliases(cached.Aliases)
+	return pkgs
+}
+
+// packagesKey returns the key for the packages converted from query.
+// select() is resolved for the platform and policy in the request, so they are part of the key,
+// along with the bazel flags in the request, which can change the generated files.
+// Binaries that register converters share the cache with the driver, so the
+// registered rule classes are part of the key too.
+func (d *bazelDriver) packagesKey(query string) string {
+	ctxt := pkgconv.BuildContext(&d.cfg)
+	policy := driver.GetEnv(&d.cfg, pkgconv.SelectEnv, pkgconv.SelectPlatform)
+	bazelFlags, _ := splitBuildFlags(d.cfg.BuildFlags)
+	platform := ctxt.GOOS + "_" + ctxt.GOARCH
+	if ctxt.GOARCH == "arm" {
+		// GOARM picks between the arm and armv7 cpu constraints.
+		platform += "v" + driver.GetEnv(&d.cfg, "GOARM", "")
+	}
+	return fmt.Sprintf("%v %v %v %v %v", query, platform, policy, strings.Join(bazelFlags, " "), strings.Join(pkgconv.Registered(), ","))
+}
+
+// queryKey returns the key for the result of expr.
+// The bazel flags in the request that are passed to query are part of the key.
+func (d *bazelDriver) queryKey(expr string) string {
+	bazelFlags, _ := splitBuildFlags(d.cfg.BuildFlags)
+	if flags := queryFlags(bazelFlags); len(flags) > 0 {
+		return expr + " " + strings.Join(flags, " ")
+	}
+	return expr
+}
+
+// savePackages saves the packages converted from the result of query.
+// The stamps include the BUILD and .bzl files used by the query, the
+// test sources that were parsed to split up the test packages, and the other
+// sources in read whose contents were used.
+func (d *bazelDriver) savePackages(query string, result *blaze_query.QueryResult, pkgs []*packages.Package, read []string) {
+	stamps, err := d.buildfileStamps(query, result)
+	if err != nil {
+		log.Printf("not caching %#v: %v", query, err)
+		return
+	}
+	for _, pkg := range pkgs {
+		if strings.Contains(pkg.ID, " [") {
+			read = append(read, pkg.GoFiles...)
+		}
+	}
+	for _, f := range read {
+		if driver.InOverlay(&d.cfg, f) {
+			return
+		}
+		if _, ok := stamps[f]; !ok {
+			stamps[f] = newStamp(f)
+		}
+	}
+	data, err := json.Marshal(pkgs)
+	if err != nil {
+		return
+	}
+	d.ws.Packages[d.packagesKey(query)] = &cachedPackages{
+		Packages: data,
+		Aliases:  d.aliasTargets(result),
+		Stamps:   stamps,
+	}
+	d.ws.dirty = true
+}
+
+// buildfileStamps returns the queryStamps for result, along with the stamps
+// for the BUILD and .bzl files that query depends on.
+func (d *bazelDriver) buildfileStamps(query string, result *blaze_query.QueryResult) (map[string]fileStamp, error) {
+	stamps := d.queryStamps(query, result)
+	// The errors are the same as the ones for query, so they aren't reported
+	// again, but the broken files are stamped.
+	buildfiles, err := d.bazel.Query(fmt.Sprintf("buildfiles(%v)", query))
+	if qerr, ok := err.(*queryError); ok && buildfiles != nil {
+		addErrorStamps(stamps, qerr.errs)
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for filename, stamp := range d.queryStamps("", buildfiles) {
+		stamps[filename] = stamp
+	}
+	return stamps, nil
+}
+
+// addErrorStamps adds the stamps of the files that have errors to stamps.
+func addErrorStamps(stamps map[string]fileStamp, errs []packages.Error) {
+	for _, e := range errs {
+		if filename := locationSuffix.ReplaceAllString(e.Pos, ""); filename != "" {
+			if _, ok := stamps[filename]; !ok {
+				stamps[filename] = newStamp(filename)
+			}
+		}
+	}
+}
+
+// queryStamps returns the stamps for the BUILD files of each target in result.
+// Wildcards can match new packages, so for those the directories they match
+// are included too: the subtree for /..., and the directory itself for :all,
+// in case its BUILD file is created.
+func (d *bazelDriver) queryStamps(expr string, result *blaze_query.QueryResult) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	add := func(filename string) {
+		if _, ok := stamps[filename]; ok || filename == "" {
+			return
+		}
+		stamps[filename] = newStamp(filename)
+	}
+	for _, t := range result.GetTarget() {
+		var location string
+		switch t.GetType() {
+		case blaze_query.Target_RULE:
+			location = t.GetRule().GetLocation()
+		case blaze_query.Target_SOURCE_FILE:
+			location = t.GetSourceFile().GetLocation()
+		}
+		add(locationSuffix.ReplaceAllString(location, ""))
+	}
+	for _, m := range subtreePattern.FindAllStringSubmatch(expr, -1) {
+		dir := filepath.Join(d.workspaceRoot, filepath.FromSlash(m[1]))
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			if name := info.Name(); path != dir && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "bazel-")) {
+				return filepath.SkipDir
+			}
+			add(path)
+			return nil
+		})
+	}
+	for _, m := range packageWildcardPattern.FindAllStringSubmatch(expr, -1) {
+		add(filepath.Join(d.workspaceRoot, filepath.FromSlash(m[1])))
+	}
+	return stamps
+}
+
+// subtreePattern matches the /... target patterns in the main repository,
+// and packageWildcardPattern the :all patterns. The first group is the
+// workspace relative directory.
+var (
+	subtreePattern         = regexp.MustCompile(`(?:^|[^@\w])//((?:[^\s:'"()+,]*/)?)\.\.\.`)
+	packageWildcardPattern = regexp.MustCompile(`(?:^|[^@\w])//([^\s:'"()+,]*):(?:all-targets|all|\*)(?:[^\w-]|$)`)
+)
+
+// newStamp returns the current stamp for filename.
+// Missing files have a zero stamp.
+func newStamp(filename string) fileStamp {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return fileStamp{}
+	}
+	stamp := fileStamp{ModTime: fi.ModTime(), Size: fi.Size()}
+	if !fi.IsDir() {
+		stamp.Hash = hashFile(filename)
+	}
+	return stamp
+}
+
+func hashFile(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func stampsMatch(stamps map[string]fileStamp) bool {
+	for filename, stamp := range stamps {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			if stamp != (fileStamp{}) {
+				return false
+			}
+			continue
+		}
+		if fi.ModTime().Equal(stamp.ModTime) && fi.Size() == stamp.Size {
+			continue
+		}
+		if fi.IsDir() || fi.Size() != stamp.Size || stamp.Hash == "" || hashFile(filename) != stamp.Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// cachedParse returns the previous parse results for filename if it hasn't changed.
+// Files in the overlay are never cached.
+func (d *bazelDriver) cachedParse(filename string) *parsedFile {
+	if driver.InOverlay(&d.cfg, filename) {
+		return nil
+	}
+	if cached := d.ws.Files[filename]; cached != nil && stampsMatch(map[string]fileStamp{filename: cached.Stamp}) {
+		return cached
+	}
+	return nil
+}
+
+func (d *bazelDriver) saveParse(filename string, parsed *parsedFile) {
+	if driver.InOverlay(&d.cfg, filename) {
+		return
+	}
+	if stamp := newStamp(filename); stamp != (fileStamp{}) {
+		parsed.Stamp = stamp
+		d.ws.Files[filename] = parsed
+		d.ws.dirty = true
+	}
+}